@@ -0,0 +1,215 @@
+// Package bytesize provides ByteSize, a byte count that reads and
+// prints in human units ("10MB", "2GiB", "512k", "1.5 GiB"). It is
+// built on the `1 << (10 * iota)` constants of the constants tutorial
+// and is meant for upload limits, buffer sizes and config files.
+package bytesize
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// ByteSize is a number of bytes.
+type ByteSize uint64
+
+// Binary (IEC) units: powers of 1024.
+const (
+	_            = iota             // ignore first value by assigning to blank identifier.
+	KiB ByteSize = 1 << (10 * iota) // 1 << (10 * 1) = 2^10
+	MiB                             // 2^20
+	GiB                             // 2^30
+	TiB
+	PiB
+	EiB
+)
+
+// Decimal (SI) units: powers of 1000.
+const (
+	KB ByteSize = 1000
+	MB          = 1000 * KB
+	GB          = 1000 * MB
+	TB          = 1000 * GB
+	PB          = 1000 * TB
+	EB          = 1000 * PB
+)
+
+// ZiB (2^70), YiB (2^80), ZB and YB exceed the 64 bits of a
+// ByteSize, whose maximum is just under 16 EiB. They are not
+// declared as constants; Parse still understands them and
+// reports ErrOverflow when the result does not fit.
+
+// ErrOverflow is returned when a size does not fit in a ByteSize.
+var ErrOverflow = errors.New("bytesize: value out of range")
+
+// multipliers maps the lower-cased unit prefix to its factors:
+// the first for the SI spelling ("MB", "M"), the second for
+// IEC ("MiB", "Mi").
+var multipliers = map[string][2]*big.Int{
+	"":  {big.NewInt(1), big.NewInt(1)},
+	"k": {pow(1000, 1), pow(1024, 1)},
+	"m": {pow(1000, 2), pow(1024, 2)},
+	"g": {pow(1000, 3), pow(1024, 3)},
+	"t": {pow(1000, 4), pow(1024, 4)},
+	"p": {pow(1000, 5), pow(1024, 5)},
+	"e": {pow(1000, 6), pow(1024, 6)},
+	"z": {pow(1000, 7), pow(1024, 7)},
+	"y": {pow(1000, 8), pow(1024, 8)},
+}
+
+func pow(base, exp int64) *big.Int {
+	return new(big.Int).Exp(big.NewInt(base), big.NewInt(exp), nil)
+}
+
+// Parse reads a size such as "512", "10MB", "2GiB", "1.5 TB" or "512k".
+//
+// Units are case-insensitive. A trailing "i" selects binary units
+// (KiB = 1024), everything else is decimal (kB = k = 1000). The
+// trailing "B" is optional. Fractions are rounded to the nearest byte.
+func Parse(s string) (ByteSize, error) {
+	in := s
+	s = strings.TrimSpace(s)
+
+	// Split "1.5 GiB" into the number and the unit.
+	end := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if end < 0 {
+		end = len(s)
+	}
+	number, unit := s[:end], strings.ToLower(strings.TrimSpace(s[end:]))
+	if number == "" {
+		return 0, fmt.Errorf("bytesize: invalid size %q", in)
+	}
+
+	unit = strings.TrimSuffix(unit, "b")
+	iec := 0
+	if strings.HasSuffix(unit, "i") {
+		unit = strings.TrimSuffix(unit, "i")
+		iec = 1
+		if unit == "" {
+			return 0, fmt.Errorf("bytesize: invalid unit in %q", in)
+		}
+	}
+	factors, ok := multipliers[unit]
+	if !ok {
+		return 0, fmt.Errorf("bytesize: invalid unit in %q", in)
+	}
+
+	// Exact arithmetic: big.Rat parses "1.5" without binary
+	// rounding and the factors go up to 2^80.
+	value, ok := new(big.Rat).SetString(number)
+	if !ok {
+		return 0, fmt.Errorf("bytesize: invalid size %q", in)
+	}
+	value.Mul(value, new(big.Rat).SetInt(factors[iec]))
+
+	// Round half up to a whole number of bytes.
+	value.Add(value, big.NewRat(1, 2))
+	bytes := new(big.Int).Quo(value.Num(), value.Denom())
+	if !bytes.IsUint64() {
+		return 0, fmt.Errorf("%w: %q", ErrOverflow, in)
+	}
+	return ByteSize(bytes.Uint64()), nil
+}
+
+// MustParse is Parse for constants known to be valid; it panics on error.
+func MustParse(s string) ByteSize {
+	b, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+var iecUnits = []struct {
+	size ByteSize
+	name string
+}{
+	{EiB, "EiB"},
+	{PiB, "PiB"},
+	{TiB, "TiB"},
+	{GiB, "GiB"},
+	{MiB, "MiB"},
+	{KiB, "KiB"},
+}
+
+// String formats b in the largest binary unit that keeps the
+// number at least 1, with up to two decimals: "1.5 GiB", "512 B".
+// A value that rounds to 1024 of a unit is written in the next
+// one ("1 MiB", not "1024 KiB"), and the result always parses.
+func (b ByteSize) String() string {
+	for i, unit := range iecUnits {
+		if b < unit.size {
+			continue
+		}
+		n := hundredths(b, unit.size)
+		if n >= 1024*100 && i > 0 {
+			unit = iecUnits[i-1]
+			n = hundredths(b, unit.size)
+		}
+		if unit.size == EiB && n >= 16*100 {
+			// 16 EiB does not fit in a ByteSize.
+			n = 16*100 - 1
+		}
+		return strconv.FormatFloat(float64(n)/100, 'f', -1, 64) + " " + unit.name
+	}
+	return strconv.FormatUint(uint64(b), 10) + " B"
+}
+
+// hundredths returns b/unit in hundredths, rounded half up. It
+// works on 128 bits, as b*100 easily exceeds a uint64.
+func hundredths(b, unit ByteSize) uint64 {
+	hi, lo := bits.Mul64(uint64(b), 100)
+	lo, carry := bits.Add64(lo, uint64(unit)/2, 0)
+	n, _ := bits.Div64(hi+carry, lo, uint64(unit))
+	return n
+}
+
+// Set and the String method above make *ByteSize a flag.Value:
+//
+//	limit := 10 * bytesize.MiB
+//	flag.Var(&limit, "max-upload", "maximum upload size")
+func (b *ByteSize) Set(s string) error {
+	parsed, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*b = parsed
+	return nil
+}
+
+// MarshalText writes b exactly, in the largest binary unit that
+// divides it ("2GiB", "1536KiB") or as a plain byte count. Unlike
+// String it never rounds, so the value survives a round trip.
+func (b ByteSize) MarshalText() ([]byte, error) {
+	for _, unit := range iecUnits {
+		if b >= unit.size && b%unit.size == 0 {
+			return []byte(strconv.FormatUint(uint64(b/unit.size), 10) + unit.name), nil
+		}
+	}
+	return []byte(strconv.FormatUint(uint64(b), 10)), nil
+}
+
+func (b *ByteSize) UnmarshalText(text []byte) error {
+	return b.Set(string(text))
+}
+
+// UnmarshalJSON accepts a string such as "10MB" or a plain number
+// of bytes. MarshalJSON is provided by MarshalText.
+func (b *ByteSize) UnmarshalJSON(data []byte) error {
+	var n uint64
+	if err := json.Unmarshal(data, &n); err == nil {
+		*b = ByteSize(n)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("bytesize: want a string or number, got %s", data)
+	}
+	return b.Set(s)
+}
@@ -0,0 +1,139 @@
+package bytesize
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want ByteSize
+	}{
+		{"0", 0},
+		{"512", 512},
+		{"512b", 512},
+		{"10MB", 10 * MB},
+		{"10 mb", 10 * MB},
+		{"512k", 512 * KB},
+		{"2GiB", 2 * GiB},
+		{"2gi", 2 * GiB},
+		{" 1.5 GiB ", 3 * GiB / 2},
+		{"1.5 TB", 1500 * GB},
+		{"0.5", 1},       // rounded half up
+		{"0.0001KiB", 0}, // 0.1024 bytes
+		{"16EB", 16 * EB},
+		{"18446744073709551615", math.MaxUint64},
+		{"0.000001 ZB", PB},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("Parse(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "MB", "1.2.3", "10 XB", "10i", "-1", "1 GiBB"} {
+		if _, err := Parse(in); err == nil || errors.Is(err, ErrOverflow) {
+			t.Errorf("Parse(%q) = %v, want a syntax error", in, err)
+		}
+	}
+	for _, in := range []string{"16EiB", "18446744073709551616", "19EB", "1ZB", "1 ZiB", "1YB", "1yib"} {
+		if _, err := Parse(in); !errors.Is(err, ErrOverflow) {
+			t.Errorf("Parse(%q) = %v, want ErrOverflow", in, err)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		b    ByteSize
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{KiB, "1 KiB"},
+		{1536, "1.5 KiB"},
+		{10 * MB, "9.54 MiB"},
+		{3 * GiB / 2, "1.5 GiB"},
+		{MiB - 1, "1 MiB"},
+		{GiB - 5*KiB, "1 GiB"},
+		{EiB - 1, "1 EiB"},
+		{math.MaxUint64, "15.99 EiB"},
+	}
+	for _, tt := range tests {
+		got := tt.b.String()
+		if got != tt.want {
+			t.Errorf("String(%d) = %q, want %q", uint64(tt.b), got, tt.want)
+		}
+		if _, err := Parse(got); err != nil {
+			t.Errorf("Parse(String(%d)): %v", uint64(tt.b), err)
+		}
+	}
+}
+
+func TestText(t *testing.T) {
+	tests := []struct {
+		b    ByteSize
+		want string
+	}{
+		{0, "0"},
+		{512, "512"},
+		{2 * GiB, "2GiB"},
+		{1536 * KiB, "1536KiB"},
+		{10 * MB, "10000000"},
+		{math.MaxUint64, "18446744073709551615"},
+	}
+	for _, tt := range tests {
+		text, err := tt.b.MarshalText()
+		if err != nil || string(text) != tt.want {
+			t.Errorf("MarshalText(%d) = %s, %v, want %s", uint64(tt.b), text, err, tt.want)
+		}
+		var got ByteSize
+		if err := got.UnmarshalText(text); err != nil || got != tt.b {
+			t.Errorf("text round trip of %s = %d, %v", text, uint64(got), err)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	type config struct {
+		Limit ByteSize `json:"limit"`
+	}
+
+	data, err := json.Marshal(config{Limit: 10 * MiB})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"limit":"10MiB"}`; string(data) != want {
+		t.Errorf("Marshal = %s, want %s", data, want)
+	}
+	var c config
+	if err := json.Unmarshal(data, &c); err != nil || c.Limit != 10*MiB {
+		t.Errorf("round trip = %d, %v", uint64(c.Limit), err)
+	}
+
+	tests := []struct {
+		in   string
+		want ByteSize
+	}{
+		{`{"limit": "2GB"}`, 2 * GB},
+		{`{"limit": 4096}`, 4 * KiB},
+		{`{"limit": "1.5 KiB"}`, 1536},
+	}
+	for _, tt := range tests {
+		var c config
+		if err := json.Unmarshal([]byte(tt.in), &c); err != nil || c.Limit != tt.want {
+			t.Errorf("Unmarshal(%s) = %d, %v, want %d", tt.in, uint64(c.Limit), err, uint64(tt.want))
+		}
+	}
+
+	for _, in := range []string{`{"limit": true}`, `{"limit": -1}`, `{"limit": "lots"}`, `{"limit": "1ZB"}`} {
+		var c config
+		if err := json.Unmarshal([]byte(in), &c); err == nil {
+			t.Errorf("Unmarshal(%s) succeeded, want an error", in)
+		}
+	}
+}
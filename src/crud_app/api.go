@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The movie API is served in two versions:
+//
+//	/v1/movies  the original wire format, kept as-is for
+//	            existing clients (the title lives under the
+//	            "string" key). The unversioned /movies routes
+//	            are an alias of v1.
+//	/v2/movies  the stable schema: Movie serialized directly,
+//	            with "title", "director_id" and the created/updated
+//	            timestamps.
+//
+// The handlers are shared; only the payload shape differs.
+
+// movieV1 is the legacy JSON shape of a movie.
+type movieV1 struct {
+	ID       string    `json:"id"`
+	Isbn     string    `json:"isbn" validate:"required,isbn"`
+	Title    string    `json:"string" validate:"required,max=200"`
+	Director *Director `json:"director" validate:"required"`
+}
+
+func toV1(movie Movie) movieV1 {
+	legacy := movieV1{
+		ID:    movie.ID,
+		Isbn:  movie.Isbn,
+		Title: movie.Title,
+	}
+	if movie.Director != nil {
+		// v1 directors only ever had a name.
+		legacy.Director = &Director{
+			Firstname: movie.Director.Firstname,
+			Lastname:  movie.Director.Lastname,
+		}
+	}
+	return legacy
+}
+
+func (m movieV1) toMovie() Movie {
+	return Movie{
+		ID:       m.ID,
+		Isbn:     m.Isbn,
+		Title:    m.Title,
+		Director: m.Director,
+	}
+}
+
+// apiVersion reports which version of the API the request targets.
+func apiVersion(r *http.Request) int {
+	if strings.HasPrefix(r.URL.Path, "/v2/") {
+		return 2
+	}
+	return 1
+}
+
+// apiPrefix returns the path prefix the request came in on,
+// so links we hand out point back to the same version.
+func apiPrefix(r *http.Request) string {
+	for _, prefix := range []string{"/v1", "/v2"} {
+		if strings.HasPrefix(r.URL.Path, prefix+"/") {
+			return prefix
+		}
+	}
+	return ""
+}
+
+// presentMovie converts a stored movie into the
+// payload of the API version being served.
+func presentMovie(r *http.Request, movie Movie) any {
+	if movie.Director == nil {
+		movies := []Movie{movie}
+		if err := expandDirectors(r.Context(), movies); err != nil {
+			log.Println("Error: expanding director:", err)
+		}
+		movie = movies[0]
+	}
+	if apiVersion(r) == 1 {
+		return toV1(movie)
+	}
+	return movie
+}
+
+// movieList is the v2 envelope of a page of movies.
+// Next is the cursor of the following page, if any.
+type movieList struct {
+	Data []Movie `json:"data"`
+	Next string  `json:"next,omitempty"`
+}
+
+// presentMovies converts a page of movies. v1 keeps the
+// bare JSON array; v2 wraps it in movieList.
+func presentMovies(r *http.Request, movies []Movie, next string) any {
+	if err := expandDirectors(r.Context(), movies); err != nil {
+		log.Println("Error: expanding directors:", err)
+	}
+	if apiVersion(r) == 1 {
+		legacy := make([]movieV1, len(movies))
+		for i, movie := range movies {
+			legacy[i] = toV1(movie)
+		}
+		return legacy
+	}
+	return movieList{Data: movies, Next: next}
+}
+
+// decodeMovie reads and validates a movie payload in the shape
+// of the requested API version. It writes the error response
+// itself and reports whether the payload was acceptable.
+func decodeMovie(w http.ResponseWriter, r *http.Request) (Movie, bool) {
+	return parseMovie(w, r, r.Body)
+}
+
+// parseMovie is decodeMovie for a body other than the request's own.
+func parseMovie(w http.ResponseWriter, r *http.Request, body io.Reader) (Movie, bool) {
+	if apiVersion(r) == 1 {
+		var payload movieV1
+		if !decodeJSON(w, r, body, &payload) {
+			return Movie{}, false
+		}
+		if errs := validate(payload); errs != nil {
+			writeValidationError(w, r, errs)
+			return Movie{}, false
+		}
+		return payload.toMovie(), true
+	}
+
+	var movie Movie
+	if !decodeJSON(w, r, body, &movie) {
+		return Movie{}, false
+	}
+	if errs := validate(movie); errs != nil {
+		writeValidationError(w, r, errs)
+		return Movie{}, false
+	}
+	// Timestamps and the version are owned by the store.
+	movie.CreatedAt = time.Time{}
+	movie.UpdatedAt = time.Time{}
+	movie.Version = 0
+	return movie, true
+}
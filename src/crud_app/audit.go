@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Every write to a movie is recorded as a revision, so its
+// earlier states can be listed and brought back:
+//
+//	GET  /movies/{id}/history        every revision, oldest first
+//	POST /movies/{id}/restore?rev=N  make revision N current again
+//
+// With -store=file the revisions are journaled to -audit-data,
+// next to the movies themselves.
+
+// audit records the revisions, set up in main().
+var audit *auditLog
+
+// revision is one recorded write. Before and After are the
+// stored movie around the write; Before is missing for
+// creates, After for deletes.
+type revision struct {
+	MovieID      string        `json:"movie_id"`
+	Rev          int           `json:"rev"`
+	Op           string        `json:"op"`
+	Actor        string        `json:"actor"`
+	At           time.Time     `json:"at"`
+	Before       *Movie        `json:"before,omitempty"`
+	After        *Movie        `json:"after,omitempty"`
+	Changes      []fieldChange `json:"changes"`
+	RestoredFrom int           `json:"restored_from,omitempty"`
+}
+
+// fieldChange is one field that differs between Before and After.
+type fieldChange struct {
+	Field string `json:"field"`
+	From  any    `json:"from"`
+	To    any    `json:"to"`
+}
+
+// revisionList is the v2 envelope of a movie's history.
+type revisionList struct {
+	Data []revision `json:"data"`
+}
+
+// auditLog keeps the revisions of every movie, including
+// movies that have been deleted since.
+type auditLog struct {
+	mu      sync.RWMutex
+	byMovie map[string][]revision
+	journal *journal // nil when nothing is persisted
+}
+
+// newAuditLog replays the journal at path, if one is given.
+func newAuditLog(path string) (*auditLog, error) {
+	a := &auditLog{byMovie: map[string][]revision{}}
+	if path == "" {
+		return a, nil
+	}
+
+	j, err := openJournal(path, func(line []byte) error {
+		var rev revision
+		if err := json.Unmarshal(line, &rev); err != nil {
+			return err
+		}
+		a.byMovie[rev.MovieID] = append(a.byMovie[rev.MovieID], rev)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	a.journal = j
+	return a, nil
+}
+
+func (a *auditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.journal == nil {
+		return nil
+	}
+	return a.journal.Close()
+}
+
+// onMovieEvent is the movieListener recording the revisions.
+func (a *auditLog) onMovieEvent(ctx context.Context, event movieEvent) {
+	rev := revision{
+		MovieID: event.Movie.ID,
+		Op:      auditOp(event),
+		Actor:   actor(ctx),
+		At:      time.Now().UTC(),
+		Before:  event.Before,
+	}
+	if event.Op != opDelete {
+		after := event.Movie
+		rev.After = &after
+	}
+	rev.Changes = diffMovies(rev.Before, rev.After)
+	if from, ok := ctx.Value(restoreKey).(int); ok {
+		rev.RestoredFrom = from
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	rev.Rev = len(a.byMovie[rev.MovieID]) + 1
+	if a.journal != nil {
+		// The movie itself is already written, so all we
+		// can do about a failing audit journal is complain.
+		if err := a.journal.append(rev); err != nil {
+			log.Printf("Error: recording revision %d of movie %s: %v", rev.Rev, rev.MovieID, err)
+		}
+	}
+	a.byMovie[rev.MovieID] = append(a.byMovie[rev.MovieID], rev)
+}
+
+func (a *auditLog) history(id string) []revision {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	revs := make([]revision, len(a.byMovie[id]))
+	copy(revs, a.byMovie[id])
+	return revs
+}
+
+func (a *auditLog) revision(id string, rev int) (revision, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	revs := a.byMovie[id]
+	if rev < 1 || rev > len(revs) {
+		return revision{}, false
+	}
+	return revs[rev-1], true
+}
+
+// auditOp names the write: the store's op, except that moving
+// a movie in or out of the trash is recorded as "trash" or
+// "undelete" rather than as a plain update.
+func auditOp(event movieEvent) string {
+	if event.Op != opUpdate {
+		return event.Op
+	}
+	switch wasTrashed, isTrashed := event.Before.DeletedAt != nil, event.Movie.DeletedAt != nil; {
+	case isTrashed && !wasTrashed:
+		return "trash"
+	case wasTrashed && !isTrashed:
+		return "undelete"
+	}
+	return event.Op
+}
+
+// actor names whoever made the request behind ctx. Writes
+// outside of a request, like seeding, are made by "system".
+func actor(ctx context.Context) string {
+	if p, ok := ctx.Value(principalKey).(principal); ok {
+		return p.Subject
+	}
+	return "system"
+}
+
+// diffMovies lists the JSON fields that differ between before
+// and after (either may be nil). The bookkeeping fields that
+// change on every write are left out.
+func diffMovies(before, after *Movie) []fieldChange {
+	from, to := movieFields(before), movieFields(after)
+
+	changes := []fieldChange{}
+	for field := range from {
+		if _, ok := to[field]; !ok {
+			to[field] = nil
+		}
+	}
+	for field, value := range to {
+		if field == "updated_at" || field == "version" {
+			continue
+		}
+		if !reflect.DeepEqual(from[field], value) {
+			changes = append(changes, fieldChange{Field: field, From: from[field], To: value})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
+
+func movieFields(movie *Movie) map[string]any {
+	fields := map[string]any{}
+	if movie == nil {
+		return fields
+	}
+	data, err := json.Marshal(movie)
+	if err == nil {
+		err = json.Unmarshal(data, &fields)
+	}
+	if err != nil {
+		log.Println("Error: diffing movie:", err)
+	}
+	return fields
+}
+
+func getMovieHistory(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	revs := audit.history(id)
+	if len(revs) == 0 {
+		if _, err := store.Get(r.Context(), id); err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+	}
+	if apiVersion(r) == 2 {
+		writeJSON(w, http.StatusOK, revisionList{Data: revs})
+		return
+	}
+	writeJSON(w, http.StatusOK, revs)
+}
+
+// restoreMovie makes an earlier revision the current state of
+// the movie, recreating it if it was deleted. The restore is a
+// write of its own and shows up in the history as well.
+func restoreMovie(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	n, err := strconv.Atoi(r.URL.Query().Get("rev"))
+	if err != nil || n < 1 {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "rev must be a revision number")
+		return
+	}
+	rev, ok := audit.revision(id, n)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, codeNotFound, fmt.Sprintf("movie has no revision %d", n))
+		return
+	}
+	if rev.After == nil {
+		writeError(w, r, http.StatusConflict, codeConflict,
+			fmt.Sprintf("revision %d deleted the movie, restore an earlier one", n))
+		return
+	}
+	movie := *rev.After
+
+	directorRefs.RLock()
+	defer directorRefs.RUnlock()
+	_, err = directors.Get(r.Context(), movie.DirectorID)
+	if errors.Is(err, ErrDirectorNotFound) {
+		writeError(w, r, http.StatusConflict, codeConflict,
+			fmt.Sprintf("the director of revision %d no longer exists", n))
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), restoreKey, n)
+	status := http.StatusOK
+	current, err := store.Get(ctx, id)
+	if errors.Is(err, ErrMovieNotFound) {
+		if _, err := trash.GetAny(ctx, id); err == nil {
+			writeError(w, r, http.StatusConflict, codeConflict, "movie is in the trash, undelete it first")
+			return
+		}
+	}
+	switch {
+	case errors.Is(err, ErrMovieNotFound):
+		// Keep the original creation time, the rest
+		// of the bookkeeping starts over.
+		movie.UpdatedAt, movie.Version = time.Now(), 0
+		movie, err = insertMovie(ctx, movie)
+		status = http.StatusCreated
+	case err == nil:
+		var ok bool
+		if movie.Version, ok = checkIfMatch(w, r, current); !ok {
+			return
+		}
+		movie, err = store.Update(ctx, id, movie)
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	if status == http.StatusCreated {
+		w.Header().Set("Location", apiPrefix(r)+"/movies/"+id)
+	}
+	w.Header().Set("ETag", etag(r, movie))
+	writeJSON(w, status, presentMovie(r, movie))
+}
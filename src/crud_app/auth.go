@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"crud_app/permission"
+
+	"github.com/gorilla/mux"
+)
+
+// Permissions use the shared bit-flag encoding of the
+// permission package; the movie flags take the next free
+// bits after the tutorial's isAdmin, canSeeFinancials, ...
+var (
+	canReadMovies  = permission.Define("canReadMovies")
+	canWriteMovies = permission.Define("canWriteMovies")
+	isAdmin        = permission.Admin
+)
+
+// rolePermissions maps the "role" claim of a token to its flags.
+var rolePermissions = map[string]permission.Permission{
+	"viewer": canReadMovies,
+	"editor": canReadMovies | canWriteMovies,
+	"admin":  canReadMovies | canWriteMovies | isAdmin,
+}
+
+// jwtSecret signs and verifies bearer tokens (HS256).
+// Without it no token verifies, so every protected request
+// is refused; main() does not even start.
+var jwtSecret []byte
+
+// authDisabled turns authentication off (-insecure-no-auth):
+// every request is treated as coming from an admin. It is
+// meant for local development only.
+var authDisabled bool
+
+// principal is the authenticated caller of a request.
+type principal struct {
+	Subject     string
+	Role        string
+	Permissions permission.Permission
+}
+
+// anonymous is used for every request when authDisabled is set.
+var anonymous = principal{Subject: "anonymous", Role: "admin", Permissions: rolePermissions["admin"]}
+
+// caller returns the principal that made the request.
+func caller(r *http.Request) principal {
+	if p, ok := r.Context().Value(principalKey).(principal); ok {
+		return p
+	}
+	return anonymous
+}
+
+// requirePermission returns a wrapper that only lets requests
+// through whose bearer token grants all of the flags in want.
+// Missing or invalid tokens get 401, insufficient roles 403.
+func requirePermission(want permission.Permission) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if authDisabled {
+				next(w, r.WithContext(context.WithValue(r.Context(), principalKey, anonymous)))
+				return
+			}
+
+			token, found := bearerToken(r)
+			if !found {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="crud_app"`)
+				writeError(w, r, http.StatusUnauthorized, codeUnauthorized, "missing bearer token")
+				return
+			}
+			p, err := verifyToken(token, time.Now())
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="crud_app", error="invalid_token"`)
+				writeError(w, r, http.StatusUnauthorized, codeUnauthorized, err.Error())
+				return
+			}
+			if !p.Permissions.Has(want) {
+				writeError(w, r, http.StatusForbidden, codeForbidden, "missing permission "+want.Clear(p.Permissions).String())
+				return
+			}
+
+			next(w, r.WithContext(context.WithValue(r.Context(), principalKey, p)))
+		}
+	}
+}
+
+// queryTokenRoutes name the routes that also take the token
+// from the access_token query parameter (RFC 6750). Browsers
+// cannot set headers on EventSource and WebSocket requests;
+// everywhere else a token in the URL would only end up in
+// logs and browser histories.
+var queryTokenRoutes = map[string]bool{
+	"streamMovieEvents": true,
+	"liveMovie":         true,
+}
+
+// bearerToken returns the token of the Authorization header,
+// or of the access_token parameter on a GET to one of the
+// queryTokenRoutes.
+func bearerToken(r *http.Request) (string, bool) {
+	if token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+		return token, true
+	}
+	route := mux.CurrentRoute(r)
+	if r.Method != http.MethodGet || route == nil || !queryTokenRoutes[route.GetName()] {
+		return "", false
+	}
+	if token := r.URL.Query().Get("access_token"); token != "" {
+		return token, true
+	}
+	return "", false
+}
+
+// tokenClaims is the payload of our JWTs. Permissions, if present
+// (e.g. "canReadMovies|canWriteMovies"), replace the flags of Role.
+type tokenClaims struct {
+	Subject     string                 `json:"sub"`
+	Role        string                 `json:"role"`
+	Permissions *permission.Permission `json:"perms,omitempty"`
+	ExpiresAt   int64                  `json:"exp"`
+	NotBefore   int64                  `json:"nbf,omitempty"`
+	IssuedAt    int64                  `json:"iat,omitempty"`
+}
+
+var (
+	errMalformedToken = errors.New("malformed token")
+	errBadSignature   = errors.New("token signature is invalid")
+	errTokenExpired   = errors.New("token has expired")
+	errNoSecret       = errors.New("no -jwt-secret is configured to verify tokens")
+)
+
+// verifyToken checks an HS256-signed JWT against jwtSecret
+// and returns the principal it describes.
+func verifyToken(token string, now time.Time) (principal, error) {
+	if len(jwtSecret) == 0 {
+		// An empty HMAC key would let anyone sign tokens.
+		return principal{}, errNoSecret
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return principal{}, errMalformedToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return principal{}, errMalformedToken
+	}
+	// Only accept the algorithm we sign with; in particular
+	// never "none", which would skip the signature entirely.
+	if header.Alg != "HS256" {
+		return principal{}, errors.New("unsupported token algorithm " + header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return principal{}, errMalformedToken
+	}
+	if !hmac.Equal(signature, sign(parts[0]+"."+parts[1])) {
+		return principal{}, errBadSignature
+	}
+
+	var claims tokenClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return principal{}, errMalformedToken
+	}
+	if claims.ExpiresAt == 0 || now.Unix() >= claims.ExpiresAt {
+		return principal{}, errTokenExpired
+	}
+	if claims.NotBefore != 0 && now.Unix() < claims.NotBefore {
+		return principal{}, errors.New("token is not valid yet")
+	}
+	perms, ok := rolePermissions[claims.Role]
+	if claims.Permissions != nil {
+		perms = *claims.Permissions
+	} else if !ok {
+		return principal{}, errors.New("unknown role " + claims.Role)
+	}
+
+	return principal{Subject: claims.Subject, Role: claims.Role, Permissions: perms}, nil
+}
+
+// issueToken creates a token for subject with the given role,
+// e.g. for the -issue-token command line flag.
+func issueToken(subject, role string, ttl time.Duration, now time.Time) (string, error) {
+	if _, ok := rolePermissions[role]; !ok {
+		return "", errors.New("unknown role " + role)
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	claims, err := json.Marshal(tokenClaims{
+		Subject:   subject,
+		Role:      role,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sign(unsigned)), nil
+}
+
+func sign(unsigned string) []byte {
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte(unsigned))
+	return mac.Sum(nil)
+}
+
+func decodeSegment(segment string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
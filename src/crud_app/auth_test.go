@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// withAuth turns authentication on for the rest of the test.
+func withAuth(t *testing.T) {
+	jwtSecret, authDisabled = []byte("test secret"), false
+	t.Cleanup(func() { jwtSecret, authDisabled = nil, true })
+}
+
+func token(t *testing.T, role string) string {
+	t.Helper()
+
+	token, err := issueToken("tester", role, time.Hour, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestAuth(t *testing.T) {
+	h := newTestRouter(t)
+	withAuth(t)
+	viewer, editor := token(t, "viewer"), token(t, "editor")
+	expired, _ := issueToken("tester", "editor", -time.Minute, time.Now())
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		header []string
+		want   int
+	}{
+		{"no token", "GET", "/v2/movies", nil, 401},
+		{"header", "GET", "/v2/movies", []string{"Authorization", "Bearer " + viewer}, 200},
+		{"expired", "GET", "/v2/movies", []string{"Authorization", "Bearer " + expired}, 401},
+		{"malformed", "GET", "/v2/movies", []string{"Authorization", "Bearer x.y.z"}, 401},
+		{"viewer writes", "DELETE", "/v2/movies/1", []string{"Authorization", "Bearer " + viewer}, 403},
+		{"editor writes", "DELETE", "/v2/movies/1", []string{"Authorization", "Bearer " + editor}, 204},
+		{"editor manages webhooks", "GET", "/v2/webhooks", []string{"Authorization", "Bearer " + editor}, 403},
+
+		// The query parameter only works where browsers need it.
+		{"query on list", "GET", "/v2/movies?access_token=" + viewer, nil, 401},
+		{"query on get", "GET", "/v2/movies/1?access_token=" + viewer, nil, 401},
+		{"query on delete", "DELETE", "/v2/movies/1?access_token=" + editor, nil, 401},
+		{"query on events", "GET", "/v2/movies/events?access_token=" + viewer, []string{"Last-Event-ID", "x"}, 400},
+		{"query on live", "GET", "/v2/movies/2/live?access_token=" + viewer, nil, 426},
+		{"query on v1 live", "GET", "/v1/movies/2/live?access_token=" + viewer, nil, 426},
+		{"bad query on live", "GET", "/v2/movies/2/live?access_token=x.y.z", nil, 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := do(t, h, tt.method, tt.path, "", tt.header...)
+			if rec.Code != tt.want {
+				t.Errorf("%s %s = %d, want %d: %s", tt.method, tt.path, rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+}
+
+// TestAuthFailsClosed checks that a missing secret refuses
+// every request instead of letting it through.
+func TestAuthFailsClosed(t *testing.T) {
+	h := newTestRouter(t)
+	withAuth(t)
+	jwtSecret = nil
+	// Signed with the empty key, which anyone can do.
+	forged, _ := issueToken("mallory", "admin", time.Hour, time.Now())
+
+	for _, header := range [][]string{nil, {"Authorization", "Bearer " + forged}} {
+		if rec := do(t, h, "DELETE", "/v2/movies/1", "", header...); rec.Code != http.StatusUnauthorized {
+			t.Errorf("DELETE with header %q = %d, want 401", header, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	// ErrDirectorNotFound is returned when no director has the requested ID.
+	ErrDirectorNotFound = errors.New("director not found")
+
+	// ErrDirectorExists is returned by Create when the ID is taken.
+	ErrDirectorExists = errors.New("director already exists")
+)
+
+// DirectorStore is the persistence layer behind the /directors routes.
+// It mirrors MovieStore; directors carry no versions or timestamps.
+type DirectorStore interface {
+	List(ctx context.Context) ([]Director, error)
+	Get(ctx context.Context, id string) (Director, error)
+	Create(ctx context.Context, director Director) (Director, error)
+	Update(ctx context.Context, id string, director Director) (Director, error)
+	Delete(ctx context.Context, id string) error
+}
+
+// memoryDirectorStore keeps directors in a slice guarded by a RWMutex,
+// the same way memoryStore does for movies.
+type memoryDirectorStore struct {
+	mu        sync.RWMutex
+	directors []Director
+}
+
+func newMemoryDirectorStore() *memoryDirectorStore {
+	return &memoryDirectorStore{}
+}
+
+func (s *memoryDirectorStore) List(ctx context.Context) ([]Director, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	directors := make([]Director, len(s.directors))
+	copy(directors, s.directors)
+	return directors, nil
+}
+
+func (s *memoryDirectorStore) Get(ctx context.Context, id string) (Director, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if index := s.indexOf(id); index >= 0 {
+		return s.directors[index], nil
+	}
+	return Director{}, ErrDirectorNotFound
+}
+
+func (s *memoryDirectorStore) Create(ctx context.Context, director Director) (Director, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.indexOf(director.ID) >= 0 {
+		return Director{}, ErrDirectorExists
+	}
+	s.directors = append(s.directors, director)
+	return director, nil
+}
+
+func (s *memoryDirectorStore) Update(ctx context.Context, id string, director Director) (Director, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	index := s.indexOf(id)
+	if index < 0 {
+		return Director{}, ErrDirectorNotFound
+	}
+	director.ID = id
+	s.directors[index] = director
+	return director, nil
+}
+
+func (s *memoryDirectorStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	index := s.indexOf(id)
+	if index < 0 {
+		return ErrDirectorNotFound
+	}
+	s.directors = append(s.directors[:index], s.directors[index+1:]...)
+	return nil
+}
+
+// indexOf must be called with s.mu held.
+func (s *memoryDirectorStore) indexOf(id string) int {
+	for index, item := range s.directors {
+		if item.ID == id {
+			return index
+		}
+	}
+	return -1
+}
+
+// directorRecord is a single entry of the director journal.
+type directorRecord struct {
+	Op       string    `json:"op"`
+	ID       string    `json:"id"`
+	Director *Director `json:"director,omitempty"`
+}
+
+// fileDirectorStore persists directors into their own journal.
+// Directors change rarely, so unlike fileStore it simply keeps
+// the write lock while the record is flushed to disk.
+type fileDirectorStore struct {
+	*memoryDirectorStore
+	writeMu sync.Mutex
+	journal *journal
+}
+
+func newFileDirectorStore(path string) (*fileDirectorStore, error) {
+	s := &fileDirectorStore{memoryDirectorStore: newMemoryDirectorStore()}
+
+	j, err := openJournal(path, s.replay)
+	if err != nil {
+		return nil, err
+	}
+	s.journal = j
+	return s, nil
+}
+
+func (s *fileDirectorStore) replay(line []byte) error {
+	var record directorRecord
+	if err := json.Unmarshal(line, &record); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	var err error
+	switch record.Op {
+	case opCreate, opUpdate:
+		if record.Director == nil {
+			return errors.New("record has no director")
+		}
+		if record.Op == opCreate {
+			_, err = s.memoryDirectorStore.Create(ctx, *record.Director)
+		} else {
+			_, err = s.memoryDirectorStore.Update(ctx, record.ID, *record.Director)
+		}
+	case opDelete:
+		err = s.memoryDirectorStore.Delete(ctx, record.ID)
+	default:
+		err = fmt.Errorf("unknown op %q", record.Op)
+	}
+	return err
+}
+
+func (s *fileDirectorStore) Create(ctx context.Context, director Director) (Director, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if _, err := s.memoryDirectorStore.Get(ctx, director.ID); err == nil {
+		return Director{}, ErrDirectorExists
+	}
+	if err := s.journal.append(directorRecord{Op: opCreate, ID: director.ID, Director: &director}); err != nil {
+		return Director{}, err
+	}
+	return s.memoryDirectorStore.Create(ctx, director)
+}
+
+func (s *fileDirectorStore) Update(ctx context.Context, id string, director Director) (Director, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if _, err := s.memoryDirectorStore.Get(ctx, id); err != nil {
+		return Director{}, err
+	}
+	director.ID = id
+	if err := s.journal.append(directorRecord{Op: opUpdate, ID: id, Director: &director}); err != nil {
+		return Director{}, err
+	}
+	return s.memoryDirectorStore.Update(ctx, id, director)
+}
+
+func (s *fileDirectorStore) Delete(ctx context.Context, id string) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if _, err := s.memoryDirectorStore.Get(ctx, id); err != nil {
+		return err
+	}
+	if err := s.journal.append(directorRecord{Op: opDelete, ID: id}); err != nil {
+		return err
+	}
+	return s.memoryDirectorStore.Delete(ctx, id)
+}
+
+func (s *fileDirectorStore) Close() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	return s.journal.Close()
+}
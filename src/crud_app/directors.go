@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// Movies reference their director by ID (Movie.DirectorID).
+// Movie.Director is only filled in when a movie is sent
+// to a client, so each person is stored exactly once.
+
+// directors holds every director, chosen in main() like store.
+var directors DirectorStore
+
+// directorIDs names newly created directors (-ids flag).
+var directorIDs IDGenerator
+
+// directorDeletePolicy decides what DELETE /directors/{id} does
+// when movies, trashed ones included, still reference the
+// director (-director-delete flag):
+//
+//	reject   refuse with 409 Conflict
+//	cascade  delete the director's movies as well and purge them
+var directorDeletePolicy = "reject"
+
+// directorRefs keeps movie writes and director deletes apart.
+// Movie writes hold it for reading while they link a director,
+// a director delete holds it for writing, so no movie can start
+// pointing at a director that is being removed.
+var directorRefs sync.RWMutex
+
+// directorNames serializes findOrCreateDirector, so two requests
+// naming the same new person do not create it twice.
+var directorNames sync.Mutex
+
+func getDirectors(w http.ResponseWriter, r *http.Request) {
+	list, err := directors.List(r.Context())
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if apiVersion(r) == 2 {
+		writeJSON(w, http.StatusOK, directorList{Data: list})
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// directorList is the v2 envelope of the director collection.
+type directorList struct {
+	Data []Director `json:"data"`
+}
+
+func getDirector(w http.ResponseWriter, r *http.Request) {
+	director, err := directors.Get(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, director)
+}
+
+func createDirector(w http.ResponseWriter, r *http.Request) {
+	director, ok := decodeDirector(w, r)
+	if !ok {
+		return
+	}
+
+	director, err := newDirector(r.Context(), director)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Location", apiPrefix(r)+"/directors/"+director.ID)
+	writeJSON(w, http.StatusCreated, director)
+}
+
+func updateDirector(w http.ResponseWriter, r *http.Request) {
+	director, ok := decodeDirector(w, r)
+	if !ok {
+		return
+	}
+
+	director, err := directors.Update(r.Context(), mux.Vars(r)["id"], director)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if err := searchIdx.reindexDirector(r.Context(), director); err != nil {
+		log.Println("Error: reindexing movies of director", director.ID+":", err)
+	}
+	writeJSON(w, http.StatusOK, director)
+}
+
+func deleteDirector(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	directorRefs.Lock()
+	defer directorRefs.Unlock()
+
+	if _, err := directors.Get(r.Context(), id); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	movies, err := moviesByDirector(r.Context(), id)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	if directorDeletePolicy != "cascade" {
+		// Trashed movies count too: restoring one would
+		// bring back a dangling director_id.
+		all, err := trash.ListAll(r.Context())
+		if err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+		trashed := 0
+		for _, movie := range all {
+			if movie.DirectorID == id && movie.DeletedAt != nil {
+				trashed++
+			}
+		}
+		if len(movies) > 0 || trashed > 0 {
+			writeError(w, r, http.StatusConflict, codeConflict,
+				fmt.Sprintf("director is still referenced by %d movie(s) and %d trashed movie(s)", len(movies), trashed))
+			return
+		}
+	} else {
+		for _, movie := range movies {
+			err := store.Delete(r.Context(), movie.ID, 0)
+			if err != nil && !errors.Is(err, ErrMovieNotFound) {
+				writeStoreError(w, r, err)
+				return
+			}
+		}
+		// Trashed movies cannot outlive their director.
+		_, err = trash.Purge(r.Context(), func(movie Movie) bool {
+			return movie.DirectorID == id
+		})
+		if err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+	}
+
+	if err := directors.Delete(r.Context(), id); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getDirectorMovies lists every movie of one director.
+func getDirectorMovies(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	if _, err := directors.Get(r.Context(), id); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	movies, err := moviesByDirector(r.Context(), id)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, presentMovies(r, movies, ""))
+}
+
+func moviesByDirector(ctx context.Context, id string) ([]Movie, error) {
+	all, err := store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var movies []Movie
+	for _, movie := range all {
+		if movie.DirectorID == id {
+			movies = append(movies, movie)
+		}
+	}
+	return movies, nil
+}
+
+// decodeDirector reads and validates a director payload.
+// The ID is always assigned by the server.
+func decodeDirector(w http.ResponseWriter, r *http.Request) (Director, bool) {
+	var director Director
+	if !decodeJSON(w, r, r.Body, &director) {
+		return Director{}, false
+	}
+	if errs := validate(director); errs != nil {
+		writeValidationError(w, r, errs)
+		return Director{}, false
+	}
+	director.ID = ""
+	return director, true
+}
+
+// newDirector stores director under a freshly generated ID.
+func newDirector(ctx context.Context, director Director) (Director, error) {
+	var err error
+	for attempt := 0; attempt < maxIDAttempts; attempt++ {
+		director.ID = directorIDs.NewID()
+		var created Director
+		created, err = directors.Create(ctx, director)
+		if !errors.Is(err, ErrDirectorExists) {
+			return created, err
+		}
+	}
+	return Director{}, err
+}
+
+// findOrCreateDirector returns the stored director with the
+// same name (ignoring case), creating one if there is none.
+func findOrCreateDirector(ctx context.Context, director Director) (Director, error) {
+	directorNames.Lock()
+	defer directorNames.Unlock()
+
+	list, err := directors.List(ctx)
+	if err != nil {
+		return Director{}, err
+	}
+	for _, item := range list {
+		if strings.EqualFold(item.Firstname, director.Firstname) &&
+			strings.EqualFold(item.Lastname, director.Lastname) {
+			return item, nil
+		}
+	}
+	return newDirector(ctx, Director{Firstname: director.Firstname, Lastname: director.Lastname})
+}
+
+// linkDirector makes movie reference a stored director (see
+// resolveDirector). Callers must hold directorRefs for reading
+// until the movie has been written. It writes the error response
+// itself and reports whether the movie could be linked.
+func linkDirector(w http.ResponseWriter, r *http.Request, movie *Movie) bool {
+	errs, err := resolveDirector(r.Context(), movie, false)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return false
+	}
+	if errs != nil {
+		writeValidationError(w, r, errs)
+		return false
+	}
+	return true
+}
+
+// resolveDirector points movie at a stored director: an explicit
+// director_id must exist, otherwise the embedded director is looked
+// up by name and created if needed. With dryRun set nothing is
+// created and a new director is simply accepted.
+func resolveDirector(ctx context.Context, movie *Movie, dryRun bool) (validationErrors, error) {
+	switch {
+	case movie.DirectorID != "":
+		_, err := directors.Get(ctx, movie.DirectorID)
+		if errors.Is(err, ErrDirectorNotFound) {
+			return validationErrors{{Field: "director_id", Message: "no director with this ID"}}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	case movie.Director != nil:
+		if dryRun {
+			return nil, nil
+		}
+		director, err := findOrCreateDirector(ctx, *movie.Director)
+		if err != nil {
+			return nil, err
+		}
+		movie.DirectorID = director.ID
+	default:
+		return validationErrors{{Field: "director", Message: "is required"}}, nil
+	}
+	movie.Director = nil
+	return nil, nil
+}
+
+// expandDirectors fills in Movie.Director from DirectorID
+// so the movies can be filtered by name and sent to clients.
+func expandDirectors(ctx context.Context, movies []Movie) error {
+	list, err := directors.List(ctx)
+	if err != nil {
+		return err
+	}
+	byID := make(map[string]Director, len(list))
+	for _, director := range list {
+		byID[director.ID] = director
+	}
+	for i := range movies {
+		if director, ok := byID[movies[i].DirectorID]; ok {
+			movies[i].Director = &director
+		}
+	}
+	return nil
+}
+
+// migrateDirectors converts movies written before directors
+// became a resource, which embed their director, into movies
+// referencing a director record.
+func migrateDirectors(ctx context.Context) error {
+	movies, err := store.List(ctx)
+	if err != nil {
+		return err
+	}
+	migrated := 0
+	for _, movie := range movies {
+		if movie.Director == nil || movie.DirectorID != "" {
+			continue
+		}
+		director, err := findOrCreateDirector(ctx, *movie.Director)
+		if err != nil {
+			return err
+		}
+		movie.DirectorID = director.ID
+		movie.Director = nil
+		if _, err := store.Update(ctx, movie.ID, movie); err != nil {
+			return err
+		}
+		migrated++
+	}
+	if migrated > 0 {
+		log.Printf("linked %d movie(s) to director records", migrated)
+	}
+	return nil
+}
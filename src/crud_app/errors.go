@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+)
+
+// Error codes used in the "code" field of the error envelope.
+// Clients are expected to branch on these rather than
+// on the human readable message.
+const (
+	codeBadRequest   = "bad_request"
+	codeNotFound     = "not_found"
+	codeUnauthorized = "unauthorized"
+	codeForbidden    = "forbidden"
+	codeNotAllowed   = "method_not_allowed"
+	codeUnsupported  = "unsupported_media_type"
+	codeTooLarge     = "payload_too_large"
+	codeInvalid      = "validation_failed"
+	codeConflict     = "conflict"
+	codeStale        = "precondition_failed"
+	codeRateLimited  = "rate_limited"
+	codeStoreFull    = "insufficient_storage"
+	codeUnavailable  = "service_unavailable"
+	codeInternal     = "internal_error"
+)
+
+// apiError is the body of every failed response:
+//
+//	{"error": {"code": "not_found", "message": "...", "request_id": "..."}}
+//
+// Validation failures additionally list every offending field in Details.
+type apiError struct {
+	Code      string       `json:"code"`
+	Message   string       `json:"message"`
+	RequestID string       `json:"request_id"`
+	Details   []fieldError `json:"details,omitempty"`
+}
+
+type errorEnvelope struct {
+	Error apiError `json:"error"`
+}
+
+// writeJSON sends v as the JSON body of the response.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Error: encoding response:", err)
+	}
+}
+
+// writeError sends the error envelope with the given status.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	writeJSON(w, status, errorEnvelope{Error: apiError{
+		Code:      code,
+		Message:   message,
+		RequestID: requestID(w, r),
+	}})
+}
+
+// writeValidationError rejects a payload that failed validation
+// with 422 and the field-level list of problems.
+func writeValidationError(w http.ResponseWriter, r *http.Request, errs validationErrors) {
+	writeJSON(w, http.StatusUnprocessableEntity, errorEnvelope{Error: apiError{
+		Code:      codeInvalid,
+		Message:   "payload failed validation",
+		RequestID: requestID(w, r),
+		Details:   errs,
+	}})
+}
+
+// writeStoreError maps an error returned by the stores
+// onto the matching HTTP status.
+func writeStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrMovieNotFound), errors.Is(err, ErrDirectorNotFound),
+		errors.Is(err, ErrWebhookNotFound), errors.Is(err, ErrDeliveryNotFound):
+		writeError(w, r, http.StatusNotFound, codeNotFound, err.Error())
+	case errors.Is(err, ErrMovieExists), errors.Is(err, ErrDirectorExists), errors.Is(err, ErrMovieNotDeleted),
+		errors.Is(err, ErrDeliveryNotDead):
+		writeError(w, r, http.StatusConflict, codeConflict, err.Error())
+	case errors.Is(err, ErrVersionConflict):
+		writeError(w, r, http.StatusPreconditionFailed, codeStale, err.Error())
+	case errors.Is(err, ErrStoreFull):
+		writeError(w, r, http.StatusInsufficientStorage, codeStoreFull, err.Error())
+	default:
+		log.Println("Error:", err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "internal server error")
+	}
+}
+
+// notFound and methodNotAllowed replace the plain text
+// replies of gorilla/mux with the error envelope.
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, codeNotFound, "no route for "+r.URL.Path)
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusMethodNotAllowed, codeNotAllowed, r.Method+" is not supported on "+r.URL.Path)
+}
+
+// decodeJSON decodes body (usually r.Body) into v and
+// turns an empty or malformed body into a 400 response.
+// It reports whether decoding succeeded.
+func decodeJSON(w http.ResponseWriter, r *http.Request, body io.Reader, v any) bool {
+	err := json.NewDecoder(body).Decode(v)
+	if err == nil {
+		return true
+	}
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		writeBodyTooLarge(w, r)
+	case errors.Is(err, io.EOF):
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "request body is empty")
+	default:
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "malformed JSON: "+err.Error())
+	}
+	return false
+}
+
+// writeBodyTooLarge rejects a body that exceeded maxBodySize.
+func writeBodyTooLarge(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusRequestEntityTooLarge, codeTooLarge,
+		"request body exceeds "+maxBodySize.String())
+}
+
+// requestID returns the ID assigned to the request by the
+// requestIDs middleware. Outside of the middleware stack it
+// falls back to the client's X-Request-ID or a fresh ID,
+// which is echoed in the response headers.
+func requestID(w http.ResponseWriter, r *http.Request) string {
+	if id, ok := r.Context().Value(requestIDKey).(string); ok {
+		return id
+	}
+	id := r.Header.Get("X-Request-ID")
+	if id == "" {
+		id = newRequestID()
+	}
+	w.Header().Set("X-Request-ID", id)
+	return id
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestETagFollowsDirector(t *testing.T) {
+	h := newTestRouter(t)
+
+	tag := do(t, h, "GET", "/v2/movies/1", "").Header().Get("ETag")
+	if rec := do(t, h, "GET", "/v2/movies/1", "", "If-None-Match", tag); rec.Code != http.StatusNotModified {
+		t.Fatalf("If-None-Match with the current tag = %d, want 304", rec.Code)
+	}
+	if rec := do(t, h, "GET", "/v2/movies/1", "", "If-None-Match", `W/`+tag); rec.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match with the weak tag = %d, want 304", rec.Code)
+	}
+
+	rec := do(t, h, "PUT", "/v2/directors/1", `{"firstname": "Jane", "lastname": "Doe"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("replace director = %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = do(t, h, "GET", "/v2/movies/1", "", "If-None-Match", tag)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("If-None-Match after the director changed = %d, want 200", rec.Code)
+	}
+	if got := rec.Header().Get("ETag"); got == tag {
+		t.Errorf("ETag stayed %s after the director changed", got)
+	}
+	if movie := decode[Movie](t, rec); movie.Director.Firstname != "Jane" {
+		t.Errorf("director = %+v, want Jane", movie.Director)
+	}
+
+	rec = do(t, h, "PUT", "/v2/movies/1", newMovieV2, "If-Match", tag)
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("If-Match with the tag from before the director changed = %d, want 412", rec.Code)
+	}
+}
+
+func TestClientVersionIgnored(t *testing.T) {
+	h := newTestRouter(t)
+
+	rec := do(t, h, "POST", "/v2/movies", `{"isbn": "9780306406157", "title": "New", "director_id": "1", "version": 999}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create = %d: %s", rec.Code, rec.Body)
+	}
+	if movie := decode[Movie](t, rec); movie.Version != 1 {
+		t.Errorf("version = %d, want 1", movie.Version)
+	}
+
+	rec = do(t, h, "PUT", "/v2/movies/1", `{"isbn": "0306406152", "title": "One", "director_id": "1", "version": 999}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("replace = %d: %s", rec.Code, rec.Body)
+	}
+	if movie := decode[Movie](t, rec); movie.Version != 2 {
+		t.Errorf("version = %d, want 2", movie.Version)
+	}
+}
+
+func TestIfMatchIsStrong(t *testing.T) {
+	h := newTestRouter(t)
+
+	tag := do(t, h, "GET", "/v2/movies/1", "").Header().Get("ETag")
+	patch := `{"title": "Patched"}`
+	rec := do(t, h, "PATCH", "/v2/movies/1", patch, "Content-Type", mergePatchType, "If-Match", `W/`+tag)
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("If-Match with the weak tag = %d, want 412", rec.Code)
+	}
+	rec = do(t, h, "PATCH", "/v2/movies/1", patch, "Content-Type", mergePatchType, "If-Match", `"nope", `+tag)
+	if rec.Code != http.StatusOK {
+		t.Errorf("If-Match listing the strong tag = %d, want 200", rec.Code)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// GET /movies/events streams every change of the collection as
+// Server-Sent Events:
+//
+//	id: 42
+//	event: update
+//	data: {"id":"1","isbn":"...", ...}
+//
+// The event is the op of the revision (create, update, trash,
+// undelete or delete) and the data the movie after the change,
+// or before it for deletes. A client reconnecting with
+// Last-Event-ID gets the events it missed, as long as they are
+// still among the last eventBacklog; otherwise it is sent a
+// "reset" event and should reload the collection.
+
+const (
+	// eventBacklog is how many events are kept for resuming.
+	eventBacklog = 1000
+
+	// subscriberBuffer is how many events a subscriber may fall
+	// behind before it is dropped.
+	subscriberBuffer = 64
+
+	// heartbeatInterval keeps idle connections (and proxies) alive.
+	heartbeatInterval = 15 * time.Second
+)
+
+// changes fans the movie events out to the streams.
+var changes = newBroker()
+
+// change is one event of the stream.
+type change struct {
+	ID    uint64
+	Op    string
+	Movie Movie
+}
+
+// subscriber is one open stream. Its channel is closed
+// when the broker drops it.
+type subscriber struct {
+	events chan change
+}
+
+// broker keeps the recent events and the open streams.
+// Publishing never blocks: a subscriber whose buffer is full
+// is dropped instead, so one stalled client cannot hold up
+// the writes that publish the events.
+type broker struct {
+	mu          sync.Mutex
+	ring        [eventBacklog]change
+	lastID      uint64 // ID of the newest event, 0 before the first
+	subscribers map[*subscriber]struct{}
+	closed      bool
+}
+
+func newBroker() *broker {
+	return &broker{subscribers: map[*subscriber]struct{}{}}
+}
+
+// onMovieEvent is the movieListener feeding the broker.
+func (b *broker) onMovieEvent(ctx context.Context, event movieEvent) {
+	b.publish(auditOp(event), event.Movie)
+}
+
+func (b *broker) publish(op string, movie Movie) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	c := change{ID: b.lastID, Op: op, Movie: movie}
+	b.ring[c.ID%eventBacklog] = c
+
+	for sub := range b.subscribers {
+		select {
+		case sub.events <- c:
+		default:
+			log.Println("events: dropping a subscriber that fell behind")
+			b.dropLocked(sub)
+		}
+	}
+}
+
+// opReset tells a resuming client that events were lost.
+const opReset = "reset"
+
+// subscribe opens a stream resuming after the event lastID
+// (0 for a fresh stream) and returns the events missed since.
+// If they are no longer all in the backlog, that is a single
+// opReset event. The subscriber is nil once the broker is closed.
+func (b *broker) subscribe(lastID uint64) (sub *subscriber, missed []change) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, nil
+	}
+	sub = &subscriber{events: make(chan change, subscriberBuffer)}
+	b.subscribers[sub] = struct{}{}
+
+	if lastID == 0 {
+		return sub, nil
+	}
+	// IDs start over when the server restarts, so an ID from
+	// the future means the client saw a previous process.
+	if lastID > b.lastID || b.lastID-lastID > eventBacklog {
+		return sub, []change{{ID: b.lastID, Op: opReset}}
+	}
+	for id := lastID + 1; id <= b.lastID; id++ {
+		missed = append(missed, b.ring[id%eventBacklog])
+	}
+	return sub, missed
+}
+
+func (b *broker) unsubscribe(sub *subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.dropLocked(sub)
+}
+
+// dropLocked must be called with b.mu held.
+func (b *broker) dropLocked(sub *subscriber) {
+	if _, ok := b.subscribers[sub]; ok {
+		delete(b.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// close ends every stream and refuses new ones; it is
+// called when the server shuts down.
+func (b *broker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for sub := range b.subscribers {
+		b.dropLocked(sub)
+	}
+}
+
+func streamMovieEvents(w http.ResponseWriter, r *http.Request) {
+	var lastID uint64
+	if s := r.Header.Get("Last-Event-ID"); s != "" {
+		id, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "Last-Event-ID must be an event ID")
+			return
+		}
+		lastID = id
+	}
+
+	sub, missed := changes.subscribe(lastID)
+	if sub == nil {
+		writeError(w, r, http.StatusServiceUnavailable, codeUnavailable, "the server is shutting down")
+		return
+	}
+	defer changes.unsubscribe(sub)
+
+	// The stream outlives the server's write timeout.
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		log.Println("Error: events: clearing the write deadline:", err)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(c change) error {
+		data := []byte("{}")
+		if c.Op != opReset {
+			var err error
+			if data, err = json.Marshal(presentMovie(r, c.Movie)); err != nil {
+				return err
+			}
+		}
+		_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", c.ID, c.Op, data)
+		return err
+	}
+
+	for _, c := range missed {
+		if err := send(c); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case c, open := <-sub.events:
+			if !open {
+				// Dropped as too slow, or shutting down. The
+				// client reconnects and resumes from its last ID.
+				return
+			}
+			if err := send(c); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// publishN publishes n updates of movie 1.
+func publishN(b *broker, n int) {
+	for i := 0; i < n; i++ {
+		b.publish(opUpdate, Movie{ID: "1", Version: int64(i + 1)})
+	}
+}
+
+func TestBrokerResume(t *testing.T) {
+	b := newBroker()
+	publishN(b, 5)
+
+	tests := []struct {
+		name   string
+		lastID uint64
+		want   []uint64 // IDs of the missed events
+		reset  bool
+	}{
+		{"fresh", 0, nil, false},
+		{"behind", 3, []uint64{4, 5}, false},
+		{"up to date", 5, nil, false},
+		{"from the future", 6, []uint64{5}, true},
+	}
+	for _, tt := range tests {
+		sub, missed := b.subscribe(tt.lastID)
+		b.unsubscribe(sub)
+		var ids []uint64
+		for _, c := range missed {
+			ids = append(ids, c.ID)
+			if (c.Op == opReset) != tt.reset {
+				t.Errorf("%s: event %d is %s", tt.name, c.ID, c.Op)
+			}
+		}
+		if len(ids) != len(tt.want) || len(ids) > 0 && (ids[0] != tt.want[0] || ids[len(ids)-1] != tt.want[len(tt.want)-1]) {
+			t.Errorf("%s: missed %v, want %v", tt.name, ids, tt.want)
+		}
+	}
+
+	// The ring only keeps the last eventBacklog events.
+	publishN(b, eventBacklog)
+	last := uint64(5 + eventBacklog)
+	sub, missed := b.subscribe(last - eventBacklog)
+	b.unsubscribe(sub)
+	if len(missed) != eventBacklog || missed[0].ID != 6 || missed[len(missed)-1].ID != last || missed[0].Op != opUpdate {
+		t.Errorf("resuming from the oldest kept event: %d missed, want %d from 6", len(missed), eventBacklog)
+	}
+	sub, missed = b.subscribe(last - eventBacklog - 1)
+	b.unsubscribe(sub)
+	if len(missed) != 1 || missed[0].Op != opReset || missed[0].ID != last {
+		t.Errorf("resuming from a dropped event = %+v, want a single reset with ID %d", missed, last)
+	}
+}
+
+func TestBrokerDropsSlowSubscriber(t *testing.T) {
+	b := newBroker()
+	slow, _ := b.subscribe(0)
+	fast, _ := b.subscribe(0)
+
+	// Publishing must not wait for the slow subscriber.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i <= subscriberBuffer; i++ {
+			publishN(b, 1)
+			<-fast.events
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publish blocked on a subscriber that does not read")
+	}
+
+	got := 0
+	for range slow.events {
+		got++
+	}
+	if got != subscriberBuffer {
+		t.Errorf("slow subscriber got %d events before being dropped, want %d", got, subscriberBuffer)
+	}
+
+	publishN(b, 1)
+	if c, open := <-fast.events; !open || c.ID != subscriberBuffer+2 {
+		t.Errorf("fast subscriber got %+v, %v, want event %d", c, open, subscriberBuffer+2)
+	}
+	b.close()
+	if _, open := <-fast.events; open {
+		t.Error("close left a stream open")
+	}
+	if sub, _ := b.subscribe(0); sub != nil {
+		t.Error("subscribe after close returned a stream")
+	}
+}
+
+// TestMovieEventsResume reconnects with Last-Event-ID and
+// expects the events missed in between.
+func TestMovieEventsResume(t *testing.T) {
+	h := newTestRouter(t)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	for _, title := range []string{"One", "Two", "Three"} {
+		body := `{"title": "` + title + `"}`
+		if rec := do(t, h, "PATCH", "/v2/movies/1", body, "Content-Type", mergePatchType); rec.Code != http.StatusOK {
+			t.Fatalf("patch = %d: %s", rec.Code, rec.Body)
+		}
+	}
+
+	stream := func(lastID string, n int) []string {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/v2/movies/events", nil)
+		req.Header.Set("Last-Event-ID", lastID)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var events []string
+		scanner := bufio.NewScanner(resp.Body)
+		id := ""
+		for len(events) < n && scanner.Scan() {
+			if s, ok := strings.CutPrefix(scanner.Text(), "id: "); ok {
+				id = s
+			}
+			if event, ok := strings.CutPrefix(scanner.Text(), "event: "); ok {
+				events = append(events, id+" "+event)
+			}
+		}
+		return events
+	}
+
+	if got := stream("1", 2); len(got) != 2 || got[0] != "2 update" || got[1] != "3 update" {
+		t.Errorf("resuming after 1 = %q, want updates 2 and 3", got)
+	}
+	if got := stream("99", 1); len(got) != 1 || got[0] != "3 reset" {
+		t.Errorf("resuming after an unknown ID = %q, want a reset with ID 3", got)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// journal is an append-only log of JSON records, one per line.
+// It is the building block for the file backed stores:
+// the records are replayed into memory at startup and
+// every mutation appends a new record to the end of the file.
+type journal struct {
+	file *os.File
+}
+
+// openJournal opens (or creates) the journal at path and
+// calls replay for every complete record found in it.
+func openJournal(path string, replay func(line []byte) error) (*journal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for lineNo := 1; ; lineNo++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				// The process died in the middle of a write.
+				// Drop the partial record so the next append
+				// starts on a clean line.
+				log.Printf("journal %s: dropping partial record at line %d", path, lineNo)
+				if err := file.Truncate(offset); err != nil {
+					file.Close()
+					return nil, err
+				}
+			}
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		offset += int64(len(line))
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if err := replay(line); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("journal %s: line %d: %w", path, lineNo, err)
+		}
+	}
+
+	return &journal{file: file}, nil
+}
+
+// append writes record as a single JSON line and
+// flushes it to disk before returning.
+func (j *journal) append(record any) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+func (j *journal) Close() error {
+	return j.file.Close()
+}
+
+// movieRecord is a single entry of the movie journal.
+type movieRecord struct {
+	Op    string `json:"op"`
+	ID    string `json:"id"`
+	Movie *Movie `json:"movie,omitempty"`
+}
+
+const (
+	opCreate = "create"
+	opUpdate = "update"
+	opDelete = "delete"
+)
+
+// fileStore persists movies into an append-only journal.
+// The current state is kept in an embedded memoryStore,
+// so reads never touch the disk.
+//
+// writeMu serializes mutations so that the order of the
+// records in the journal always matches the order in
+// which they were applied to memory.
+type fileStore struct {
+	*memoryStore
+	writeMu sync.Mutex
+	journal *journal
+}
+
+func newFileStore(path string) (*fileStore, error) {
+	s := &fileStore{memoryStore: newMemoryStore()}
+
+	j, err := openJournal(path, s.replay)
+	if err != nil {
+		return nil, err
+	}
+	s.journal = j
+	return s, nil
+}
+
+// replay applies a single journal record to the in-memory state.
+func (s *fileStore) replay(line []byte) error {
+	var record movieRecord
+	if err := json.Unmarshal(line, &record); err != nil {
+		return err
+	}
+
+	switch record.Op {
+	case opCreate, opUpdate:
+		if record.Movie == nil {
+			return errors.New("record has no movie")
+		}
+		if record.Movie.Title == "" {
+			// Journals written before the v2 schema
+			// stored the title under the "string" key.
+			var legacy struct {
+				Movie movieV1 `json:"movie"`
+			}
+			if err := json.Unmarshal(line, &legacy); err != nil {
+				return err
+			}
+			record.Movie.Title = legacy.Movie.Title
+		}
+		if record.Op == opCreate {
+			s.insert(*record.Movie)
+		} else {
+			s.replace(*record.Movie)
+		}
+	case opDelete:
+		s.remove(record.ID)
+	default:
+		return fmt.Errorf("unknown op %q", record.Op)
+	}
+	return nil
+}
+
+// write journals a prepared record and then applies it to memory.
+// The memory lock is only taken for reading while preparing,
+// so GET requests are not blocked while we wait for the disk.
+func (s *fileStore) write(op, id string, prepare func() (Movie, error)) (Movie, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.mu.RLock()
+	movie, err := prepare()
+	s.mu.RUnlock()
+	if err != nil {
+		return Movie{}, err
+	}
+
+	record := movieRecord{Op: op, ID: id}
+	if op != opDelete {
+		record.Movie = &movie
+	}
+	if err := s.journal.append(record); err != nil {
+		return Movie{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch op {
+	case opCreate:
+		s.insert(movie)
+	case opUpdate:
+		s.replace(movie)
+	case opDelete:
+		s.remove(id)
+	}
+	return movie, nil
+}
+
+func (s *fileStore) Create(ctx context.Context, movie Movie) (Movie, error) {
+	return s.write(opCreate, movie.ID, func() (Movie, error) {
+		return s.prepareCreate(movie, time.Now())
+	})
+}
+
+func (s *fileStore) Update(ctx context.Context, id string, movie Movie) (Movie, error) {
+	return s.write(opUpdate, id, func() (Movie, error) {
+		return s.prepareUpdate(id, movie, time.Now())
+	})
+}
+
+func (s *fileStore) Delete(ctx context.Context, id string, version int64) error {
+	_, err := s.write(opDelete, id, func() (Movie, error) {
+		return Movie{}, s.prepareDelete(id, version)
+	})
+	return err
+}
+
+func (s *fileStore) Close() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	return s.journal.Close()
+}
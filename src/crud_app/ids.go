@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// IDGenerator hands out IDs for newly created records.
+// Implementations must be safe for concurrent use.
+type IDGenerator interface {
+	NewID() string
+}
+
+// idObserver is implemented by generators that must hear about
+// IDs chosen elsewhere, e.g. kept by an import, so they never
+// hand the same ID out again.
+type idObserver interface {
+	Observe(id string)
+}
+
+// observeID tells g about id if g cares.
+func observeID(g IDGenerator, id string) {
+	if o, ok := g.(idObserver); ok {
+		o.Observe(id)
+	}
+}
+
+// newIDGenerator returns the generator selected by the -ids flag.
+// existing are the IDs already in the store; the counter
+// starts above the largest numeric one among them.
+func newIDGenerator(kind string, existing []string) (IDGenerator, error) {
+	switch kind {
+	case "counter":
+		var max uint64
+		for _, id := range existing {
+			if n, err := strconv.ParseUint(id, 10, 64); err == nil && n > max {
+				max = n
+			}
+		}
+		return &counterGenerator{last: max}, nil
+	case "uuidv7":
+		return &uuidV7Generator{}, nil
+	case "ulid":
+		return &ulidGenerator{}, nil
+	}
+	return nil, fmt.Errorf("unknown ID generator %q (want counter, uuidv7 or ulid)", kind)
+}
+
+// counterGenerator issues "1", "2", "3", ...
+type counterGenerator struct {
+	mu   sync.Mutex
+	last uint64
+}
+
+func (g *counterGenerator) NewID() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.last++
+	return strconv.FormatUint(g.last, 10)
+}
+
+// Observe moves the counter past id if it is numeric.
+func (g *counterGenerator) Observe(id string) {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if n > g.last {
+		g.last = n
+	}
+}
+
+// uuidV7Generator issues time-ordered UUIDs (RFC 9562, version 7):
+// a 48 bit millisecond timestamp followed by random bits.
+// Within the same millisecond the 12 bit rand_a field is used
+// as a counter, so IDs from one process sort in creation order.
+type uuidV7Generator struct {
+	mu     sync.Mutex
+	lastMs int64
+	seq    uint16
+}
+
+func (g *uuidV7Generator) NewID() string {
+	var b [16]byte
+	rand.Read(b[:])
+
+	g.mu.Lock()
+	ms := time.Now().UnixMilli()
+	if ms <= g.lastMs {
+		ms = g.lastMs
+		g.seq++
+		if g.seq > 0x0fff {
+			// Counter exhausted, borrow the next millisecond.
+			ms++
+			g.seq = 0
+		}
+	} else {
+		g.seq = binary.BigEndian.Uint16(b[6:8]) & 0x07ff
+	}
+	g.lastMs = ms
+	seq := g.seq
+	g.mu.Unlock()
+
+	b[0] = byte(ms >> 40)
+	b[1] = byte(ms >> 32)
+	b[2] = byte(ms >> 24)
+	b[3] = byte(ms >> 16)
+	b[4] = byte(ms >> 8)
+	b[5] = byte(ms)
+	b[6] = 0x70 | byte(seq>>8) // version 7
+	b[7] = byte(seq)
+	b[8] = 0x80 | b[8]&0x3f // RFC 4122 variant
+
+	h := hex.EncodeToString(b[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+// crockford is the Base32 alphabet used by ULIDs.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulidGenerator issues monotonic ULIDs: a 48 bit millisecond
+// timestamp and 80 bits of randomness, encoded as 26 Crockford
+// Base32 characters. IDs generated in the same millisecond
+// increment the random part instead of drawing a new one.
+type ulidGenerator struct {
+	mu      sync.Mutex
+	lastMs  int64
+	entropy [10]byte
+}
+
+func (g *ulidGenerator) NewID() string {
+	g.mu.Lock()
+	ms := time.Now().UnixMilli()
+	if ms <= g.lastMs {
+		ms = g.lastMs
+		// Increment the 80 bit entropy as a big-endian number.
+		// On overflow the timestamp moves forward instead.
+		i := len(g.entropy) - 1
+		for ; i >= 0; i-- {
+			g.entropy[i]++
+			if g.entropy[i] != 0 {
+				break
+			}
+		}
+		if i < 0 {
+			ms++
+		}
+	} else {
+		rand.Read(g.entropy[:])
+	}
+	g.lastMs = ms
+
+	var b [16]byte
+	b[0] = byte(ms >> 40)
+	b[1] = byte(ms >> 32)
+	b[2] = byte(ms >> 24)
+	b[3] = byte(ms >> 16)
+	b[4] = byte(ms >> 8)
+	b[5] = byte(ms)
+	copy(b[6:], g.entropy[:])
+	g.mu.Unlock()
+
+	// 128 bits encode into 26 characters of 5 bits each;
+	// the first character only carries the top 3 bits.
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+	var out [26]byte
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
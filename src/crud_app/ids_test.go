@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"sync"
+	"testing"
+)
+
+func TestIDGeneratorsUnique(t *testing.T) {
+	formats := map[string]*regexp.Regexp{
+		"counter": regexp.MustCompile(`^[1-9][0-9]*$`),
+		"uuidv7":  regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`),
+		"ulid":    regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`),
+	}
+	for kind, format := range formats {
+		t.Run(kind, func(t *testing.T) {
+			g, err := newIDGenerator(kind, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			const workers, perWorker = 16, 500
+			ids := make(chan string, workers*perWorker)
+			var wg sync.WaitGroup
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < perWorker; i++ {
+						ids <- g.NewID()
+					}
+				}()
+			}
+			wg.Wait()
+			close(ids)
+
+			seen := map[string]bool{}
+			for id := range ids {
+				if !format.MatchString(id) {
+					t.Fatalf("malformed ID %q", id)
+				}
+				if seen[id] {
+					t.Fatalf("ID %s issued twice", id)
+				}
+				seen[id] = true
+			}
+		})
+	}
+}
+
+func TestIDGeneratorsSorted(t *testing.T) {
+	for _, kind := range []string{"uuidv7", "ulid"} {
+		g, _ := newIDGenerator(kind, nil)
+		last := g.NewID()
+		for i := 0; i < 5000; i++ {
+			id := g.NewID()
+			if id <= last {
+				t.Fatalf("%s: %s issued after %s", kind, id, last)
+			}
+			last = id
+		}
+	}
+}
+
+func TestCounterObserve(t *testing.T) {
+	g, _ := newIDGenerator("counter", []string{"2", "abc"})
+	observeID(g, "7")
+	observeID(g, "5")
+	observeID(g, "not-a-number")
+	if id := g.NewID(); id != "8" {
+		t.Errorf("NewID = %s, want 8", id)
+	}
+}
+
+// TestCreateAfterImport creates movies after an import kept
+// IDs the counter had not reached yet.
+func TestCreateAfterImport(t *testing.T) {
+	h := newTestRouter(t)
+
+	rows := `id,isbn,title,director_id
+3,0306406152,Three,1
+4,0306406152,Four,1
+5,0306406152,Five,1
+6,0306406152,Six,1
+7,0306406152,Seven,1
+`
+	rec := do(t, h, "POST", "/v2/movies:import?format=csv", rows)
+	if report := decode[importReport](t, rec); rec.Code != http.StatusOK || report.Imported != 5 {
+		t.Fatalf("import = %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = do(t, h, "POST", "/v2/movies", newMovieV2)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create = %d: %s", rec.Code, rec.Body)
+	}
+	if movie := decode[Movie](t, rec); movie.ID != "8" {
+		t.Errorf("ID = %s, want 8", movie.ID)
+	}
+}
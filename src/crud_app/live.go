@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// GET /movies/{id}/live upgrades to a WebSocket shared by everyone
+// looking at the same movie. All messages are JSON objects with a
+// "type". The server sends:
+//
+//	welcome  your session ID and who else is present
+//	join     someone opened the movie
+//	leave    someone left
+//	edit     someone changed a field in their editor (not saved yet)
+//	change   the movie was saved: op and the stored movie (v2 shape)
+//	error    your last message was rejected
+//
+// Clients send {"type": "edit", "field": "title", "value": "..."}
+// to share their unsaved edits; that needs canWriteMovies. The
+// server pings every livePingInterval and drops peers that stop
+// answering.
+
+const (
+	livePingInterval = 30 * time.Second
+	livePongWait     = 2 * livePingInterval
+	liveCloseGrace   = 5 * time.Second
+
+	// liveBuffer is how many messages a peer may fall behind
+	// before it is disconnected.
+	liveBuffer = 32
+)
+
+// editableFields are the fields edits may be shared for.
+var editableFields = map[string]bool{
+	"isbn":        true,
+	"title":       true,
+	"director_id": true,
+	"director":    true,
+}
+
+// live holds the rooms of the open connections.
+var live = newLiveHub()
+
+type livePeer struct {
+	Session string `json:"session"`
+	User    string `json:"user"`
+}
+
+type liveMessage struct {
+	Type    string          `json:"type"`
+	Session string          `json:"session,omitempty"`
+	User    string          `json:"user,omitempty"`
+	Present []livePeer      `json:"present,omitempty"`
+	Field   string          `json:"field,omitempty"`
+	Value   json.RawMessage `json:"value,omitempty"`
+	Op      string          `json:"op,omitempty"`
+	Movie   *Movie          `json:"movie,omitempty"`
+	Message string          `json:"message,omitempty"`
+}
+
+// liveSession is one connection. Messages for it are queued on
+// out and written by its writeLoop. The hub closes out when the
+// session leaves its room, after setting the close code the
+// writeLoop should send.
+type liveSession struct {
+	livePeer
+	conn        *wsConn
+	canEdit     bool
+	out         chan []byte
+	closeCode   int
+	closeReason string
+}
+
+type liveHub struct {
+	mu     sync.Mutex
+	rooms  map[string]map[*liveSession]struct{} // by movie ID
+	closed bool
+	conns  sync.WaitGroup // the handlers of the open connections
+}
+
+func newLiveHub() *liveHub {
+	return &liveHub{rooms: map[string]map[*liveSession]struct{}{}}
+}
+
+// join adds s to the room of the movie, welcomes it and tells
+// the others. It fails once the hub is closed.
+func (h *liveHub) join(movieID string, s *liveSession) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return false
+	}
+	h.conns.Add(1)
+	room := h.rooms[movieID]
+	if room == nil {
+		room = map[*liveSession]struct{}{}
+		h.rooms[movieID] = room
+	}
+
+	present := []livePeer{}
+	for other := range room {
+		present = append(present, other.livePeer)
+	}
+	room[s] = struct{}{}
+	h.sendLocked(movieID, s, liveMessage{Type: "welcome", Session: s.Session, User: s.User, Present: present})
+	h.broadcastLocked(movieID, liveMessage{Type: "join", Session: s.Session, User: s.User}, s)
+	return true
+}
+
+// leave removes s from the room, if it is still in it, and has
+// its writeLoop end the connection with code.
+func (h *liveHub) leave(movieID string, s *liveSession, code int, reason string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.removeLocked(movieID, s, code, reason)
+}
+
+// The *Locked methods must be called with h.mu held.
+
+func (h *liveHub) removeLocked(movieID string, s *liveSession, code int, reason string) {
+	room := h.rooms[movieID]
+	if _, ok := room[s]; !ok {
+		return
+	}
+	delete(room, s)
+	if len(room) == 0 {
+		delete(h.rooms, movieID)
+	}
+	s.closeCode, s.closeReason = code, reason
+	close(s.out)
+	h.broadcastLocked(movieID, liveMessage{Type: "leave", Session: s.Session, User: s.User}, nil)
+}
+
+// sendLocked queues msg for s without blocking; a peer whose
+// queue is full is disconnected instead.
+func (h *liveHub) sendLocked(movieID string, s *liveSession, msg liveMessage) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	select {
+	case s.out <- data:
+	default:
+		h.removeLocked(movieID, s, wsTryAgainLater, "too slow")
+	}
+}
+
+func (h *liveHub) broadcastLocked(movieID string, msg liveMessage, except *liveSession) {
+	for s := range h.rooms[movieID] {
+		if s != except {
+			h.sendLocked(movieID, s, msg)
+		}
+	}
+}
+
+func (h *liveHub) broadcast(movieID string, msg liveMessage, except *liveSession) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.broadcastLocked(movieID, msg, except)
+}
+
+func (h *liveHub) send(movieID string, s *liveSession, msg liveMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.rooms[movieID][s]; ok {
+		h.sendLocked(movieID, s, msg)
+	}
+}
+
+// onMovieEvent is the movieListener telling a room about saves.
+func (h *liveHub) onMovieEvent(ctx context.Context, event movieEvent) {
+	movie := event.Movie
+	h.broadcast(movie.ID, liveMessage{Type: "change", Op: auditOp(event), Movie: &movie}, nil)
+}
+
+// closeAll disconnects everyone; it is called on shutdown.
+func (h *liveHub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for _, room := range h.rooms {
+		for s := range room {
+			s.closeCode, s.closeReason = wsGoingAway, "server shutting down"
+			close(s.out)
+		}
+	}
+	h.rooms = map[string]map[*liveSession]struct{}{}
+}
+
+// wait gives the connections closed by closeAll up to timeout to
+// finish their closing handshakes. The HTTP server does not wait
+// for hijacked connections, so main does.
+func (h *liveHub) wait(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		h.conns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
+
+func liveMovie(w http.ResponseWriter, r *http.Request) {
+	movieID := mux.Vars(r)["id"]
+	if _, err := store.Get(r.Context(), movieID); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	conn, ok := upgradeWebSocket(w, r)
+	if !ok {
+		return
+	}
+	defer conn.conn.Close()
+
+	p := caller(r)
+	s := &liveSession{
+		livePeer: livePeer{Session: newRequestID(), User: p.Subject},
+		conn:     conn,
+		canEdit:  p.Permissions.Has(canWriteMovies),
+		out:      make(chan []byte, liveBuffer),
+	}
+	if !live.join(movieID, s) {
+		conn.sendClose(wsGoingAway, "server shutting down")
+		return
+	}
+	defer live.conns.Done()
+
+	done := make(chan struct{})
+	go s.writeLoop(done)
+
+	code, reason := s.readLoop(movieID)
+	live.leave(movieID, s, code, reason)
+	<-done
+}
+
+// readLoop handles the peer's messages until the connection ends
+// and returns the close code the server should answer with.
+func (s *liveSession) readLoop(movieID string) (int, string) {
+	for {
+		s.conn.conn.SetReadDeadline(time.Now().Add(livePongWait))
+		data, err := s.conn.readMessage()
+		var closeErr *wsCloseError
+		if errors.As(err, &closeErr) {
+			if closeErr.Peer {
+				// Echo the peer's code to complete the handshake.
+				return closeErr.Code, ""
+			}
+			return closeErr.Code, closeErr.Reason
+		}
+		if err != nil {
+			// Gone without a closing handshake, or timed out.
+			return wsGoingAway, ""
+		}
+
+		var msg liveMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			live.send(movieID, s, liveMessage{Type: "error", Message: "messages must be JSON objects"})
+			continue
+		}
+		switch {
+		case msg.Type != "edit":
+			live.send(movieID, s, liveMessage{Type: "error", Message: "unknown message type " + msg.Type})
+		case !s.canEdit:
+			live.send(movieID, s, liveMessage{Type: "error", Message: "editing needs permission canWriteMovies"})
+		case !editableFields[msg.Field]:
+			live.send(movieID, s, liveMessage{Type: "error", Message: "field " + msg.Field + " cannot be edited"})
+		default:
+			live.broadcast(movieID, liveMessage{
+				Type:    "edit",
+				Session: s.Session,
+				User:    s.User,
+				Field:   msg.Field,
+				Value:   msg.Value,
+			}, s)
+		}
+	}
+}
+
+// writeLoop sends the queued messages and the heartbeat pings.
+// Once the session has left its room it sends the close frame
+// and gives the peer liveCloseGrace to answer it.
+func (s *liveSession) writeLoop(done chan<- struct{}) {
+	defer close(done)
+
+	ping := time.NewTicker(livePingInterval)
+	defer ping.Stop()
+	for {
+		var err error
+		select {
+		case data, open := <-s.out:
+			if !open {
+				s.conn.sendClose(s.closeCode, s.closeReason)
+				s.conn.conn.SetReadDeadline(time.Now().Add(liveCloseGrace))
+				return
+			}
+			err = s.conn.writeText(data)
+		case <-ping.C:
+			err = s.conn.writeFrame(wsPing, nil)
+		}
+		if err != nil {
+			// Unblocks readLoop, which then leaves the room.
+			s.conn.conn.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsClient is the client end of a live connection, speaking the
+// protocol by hand so the tests can also send broken frames.
+type wsClient struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// The handshake example of RFC 6455, section 1.3.
+const (
+	wsSampleKey    = "dGhlIHNhbXBsZSBub25jZQ=="
+	wsSampleAccept = "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+)
+
+// liveServer serves h on a real listener, as the live channel
+// needs a connection to hijack. The handlers of the hijacked
+// connections outlive the server, so the cleanup also waits for
+// them before the next test replaces the hub.
+func liveServer(t *testing.T, h http.Handler) *httptest.Server {
+	srv := httptest.NewServer(h)
+	t.Cleanup(func() {
+		srv.Close()
+		live.closeAll()
+		live.wait(liveCloseGrace)
+	})
+	return srv
+}
+
+// dialLive opens a WebSocket on path of srv. header holds name,
+// value pairs added to the handshake.
+func dialLive(t *testing.T, srv *httptest.Server, path string, header ...string) *wsClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	request := "GET " + path + " HTTP/1.1\r\n" +
+		"Host: " + srv.Listener.Addr().String() + "\r\n" +
+		"Connection: keep-alive, Upgrade\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: " + wsSampleKey + "\r\n"
+	for i := 0; i+1 < len(header); i += 2 {
+		request += header[i] + ": " + header[i+1] + "\r\n"
+	}
+	if _, err := conn.Write([]byte(request + "\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake = %d, want 101", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != wsSampleAccept {
+		t.Fatalf("Sec-WebSocket-Accept = %q, want %q", got, wsSampleAccept)
+	}
+	return &wsClient{conn: conn, br: br}
+}
+
+// writeFrame sends one frame with the given first byte (FIN and
+// opcode) and a payload length that may differ from the payload
+// actually sent.
+func (c *wsClient) writeFrame(t *testing.T, head byte, length int, payload []byte, masked bool) {
+	t.Helper()
+
+	frame := []byte{head}
+	maskBit := byte(0)
+	if masked {
+		maskBit = 0x80
+	}
+	switch {
+	case length <= 125:
+		frame = append(frame, maskBit|byte(length))
+	case length <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+	if masked {
+		mask := []byte{0x12, 0x34, 0x56, 0x78}
+		frame = append(frame, mask...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *wsClient) send(t *testing.T, opcode byte, payload []byte) {
+	t.Helper()
+	c.writeFrame(t, 0x80|opcode, len(payload), payload, true)
+}
+
+func (c *wsClient) sendJSON(t *testing.T, v any) {
+	t.Helper()
+	data, _ := json.Marshal(v)
+	c.send(t, wsText, data)
+}
+
+// sendClose sends a close frame with code.
+func (c *wsClient) sendClose(t *testing.T, code int, reason string) {
+	t.Helper()
+	c.send(t, wsClose, append(binary.BigEndian.AppendUint16(nil, uint16(code)), reason...))
+}
+
+// next reads the next frame from the server, which never masks
+// nor fragments.
+func (c *wsClient) next(t *testing.T) (opcode byte, payload []byte) {
+	t.Helper()
+
+	head := make([]byte, 2)
+	c.readFull(t, head)
+	if head[1]&0x80 != 0 {
+		t.Fatal("the server masked a frame")
+	}
+	length := int(head[1] & 0x7f)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		c.readFull(t, ext)
+		length = int(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		c.readFull(t, ext)
+		length = int(binary.BigEndian.Uint64(ext))
+	}
+	payload = make([]byte, length)
+	c.readFull(t, payload)
+	return head[0] & 0x0f, payload
+}
+
+func (c *wsClient) readFull(t *testing.T, buf []byte) {
+	t.Helper()
+	if _, err := io.ReadFull(c.br, buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// message reads the next text message.
+func (c *wsClient) message(t *testing.T) liveMessage {
+	t.Helper()
+
+	opcode, payload := c.next(t)
+	if opcode != wsText {
+		t.Fatalf("got opcode %#x (%q), want a text message", opcode, payload)
+	}
+	var msg liveMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// expectClose reads messages up to the close frame and checks its code.
+func (c *wsClient) expectClose(t *testing.T, code int) {
+	t.Helper()
+
+	for {
+		opcode, payload := c.next(t)
+		if opcode != wsClose {
+			continue
+		}
+		if len(payload) < 2 {
+			t.Fatalf("close frame without a code, want %d", code)
+		}
+		if got := int(binary.BigEndian.Uint16(payload)); got != code {
+			t.Errorf("close code = %d (%s), want %d", got, payload[2:], code)
+		}
+		return
+	}
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	h := newTestRouter(t)
+
+	tests := []struct {
+		name   string
+		header []string
+		want   int
+	}{
+		{"no upgrade", nil, http.StatusUpgradeRequired},
+		{"old version", []string{"Connection", "Upgrade", "Upgrade", "websocket", "Sec-WebSocket-Version", "8", "Sec-WebSocket-Key", wsSampleKey}, http.StatusBadRequest},
+		{"bad key", []string{"Connection", "Upgrade", "Upgrade", "websocket", "Sec-WebSocket-Version", "13", "Sec-WebSocket-Key", "short"}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if rec := do(t, h, "GET", "/v2/movies/2/live", "", tt.header...); rec.Code != tt.want {
+			t.Errorf("%s = %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+
+	srv := liveServer(t, h)
+	// dialLive checks the accept key against the RFC's example.
+	c := dialLive(t, srv, "/v2/movies/2/live")
+	if msg := c.message(t); msg.Type != "welcome" {
+		t.Errorf("first message = %+v, want welcome", msg)
+	}
+}
+
+func TestLiveRoom(t *testing.T) {
+	h := newTestRouter(t)
+	withAuth(t)
+	srv := liveServer(t, h)
+
+	bearer := func(subject, role string) []string {
+		token, err := issueToken(subject, role, time.Hour, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []string{"Authorization", "Bearer " + token}
+	}
+	alice := dialLive(t, srv, "/v2/movies/2/live", bearer("alice", "editor")...)
+	welcome := alice.message(t)
+	if welcome.Type != "welcome" || welcome.User != "alice" || welcome.Session == "" || len(welcome.Present) != 0 {
+		t.Fatalf("alice's welcome = %+v", welcome)
+	}
+	aliceSession := welcome.Session
+
+	bob := dialLive(t, srv, "/v2/movies/2/live", bearer("bob", "viewer")...)
+	welcome = bob.message(t)
+	if welcome.Type != "welcome" || len(welcome.Present) != 1 || welcome.Present[0].Session != aliceSession {
+		t.Fatalf("bob's welcome = %+v, want alice present", welcome)
+	}
+	bobSession := welcome.Session
+	if msg := alice.message(t); msg.Type != "join" || msg.User != "bob" || msg.Session != bobSession {
+		t.Errorf("alice got %+v, want bob's join", msg)
+	}
+
+	// Viewers may watch but not edit.
+	bob.sendJSON(t, map[string]any{"type": "edit", "field": "title", "value": "Bob's"})
+	if msg := bob.message(t); msg.Type != "error" || !strings.Contains(msg.Message, "canWriteMovies") {
+		t.Errorf("bob's edit answered with %+v, want a permission error", msg)
+	}
+	alice.sendJSON(t, map[string]any{"type": "edit", "field": "version", "value": 7})
+	if msg := alice.message(t); msg.Type != "error" {
+		t.Errorf("edit of version answered with %+v, want an error", msg)
+	}
+	alice.sendJSON(t, map[string]any{"type": "edit", "field": "title", "value": "Alice's"})
+	msg := bob.message(t)
+	if msg.Type != "edit" || msg.Session != aliceSession || msg.Field != "title" || string(msg.Value) != `"Alice's"` {
+		t.Errorf("bob got %+v, want alice's title edit", msg)
+	}
+
+	// A save reaches everyone; alice's next message is this
+	// change, so her own edit was not echoed back to her.
+	rec := do(t, h, "PATCH", "/v2/movies/2", `{"title": "Saved"}`,
+		append([]string{"Content-Type", mergePatchType}, bearer("carol", "editor")...)...)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("patch = %d: %s", rec.Code, rec.Body)
+	}
+	for name, c := range map[string]*wsClient{"alice": alice, "bob": bob} {
+		if msg := c.message(t); msg.Type != "change" || msg.Op != "update" || msg.Movie == nil || msg.Movie.Title != "Saved" {
+			t.Errorf("%s got %+v, want the saved change", name, msg)
+		}
+	}
+
+	bob.sendClose(t, wsNormalClosure, "bye")
+	bob.expectClose(t, wsNormalClosure)
+	if msg := alice.message(t); msg.Type != "leave" || msg.Session != bobSession {
+		t.Errorf("alice got %+v, want bob's leave", msg)
+	}
+}
+
+func TestLiveFrames(t *testing.T) {
+	h := newTestRouter(t)
+	srv := liveServer(t, h)
+
+	open := func() *wsClient {
+		t.Helper()
+		c := dialLive(t, srv, "/v2/movies/2/live")
+		c.message(t) // welcome
+		return c
+	}
+
+	t.Run("ping", func(t *testing.T) {
+		c := open()
+		c.send(t, wsPing, []byte("are you there"))
+		if opcode, payload := c.next(t); opcode != wsPong || string(payload) != "are you there" {
+			t.Errorf("ping answered with %#x %q, want the pong", opcode, payload)
+		}
+		// Unsolicited pongs are ignored.
+		c.send(t, wsPong, nil)
+		c.sendClose(t, wsNormalClosure, "")
+		c.expectClose(t, wsNormalClosure)
+	})
+
+	t.Run("close echo", func(t *testing.T) {
+		c := open()
+		c.sendClose(t, 4000, "done here")
+		c.expectClose(t, 4000)
+	})
+
+	t.Run("unmasked", func(t *testing.T) {
+		c := open()
+		c.writeFrame(t, 0x80|wsText, 2, []byte("{}"), false)
+		c.expectClose(t, wsProtocolError)
+	})
+
+	t.Run("oversize frame", func(t *testing.T) {
+		c := open()
+		// Refused on the header, before the payload is read.
+		c.writeFrame(t, 0x80|wsText, wsMaxMessage+1, nil, true)
+		c.expectClose(t, wsMessageTooBig)
+	})
+
+	t.Run("oversize message", func(t *testing.T) {
+		c := open()
+		half := []byte(strings.Repeat("x", wsMaxMessage/2+1))
+		c.writeFrame(t, wsText, len(half), half, true)
+		c.writeFrame(t, 0x80|wsContinuation, len(half), half, true)
+		c.expectClose(t, wsMessageTooBig)
+	})
+
+	t.Run("fragmented", func(t *testing.T) {
+		c := open()
+		c.writeFrame(t, wsText, 5, []byte(`{"typ`), true)
+		c.send(t, wsPing, nil) // control frames may come in between
+		c.writeFrame(t, 0x80|wsContinuation, 11, []byte(`e": "nope"}`), true)
+		if opcode, _ := c.next(t); opcode != wsPong {
+			t.Errorf("got opcode %#x, want the pong", opcode)
+		}
+		if msg := c.message(t); msg.Type != "error" || !strings.Contains(msg.Message, "nope") {
+			t.Errorf("reassembled message answered with %+v, want an unknown type error", msg)
+		}
+	})
+}
@@ -1,140 +1,521 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
-	"math/rand"
 	"net/http"
-	"strconv"
+	"os"
+	"time"
+
+	"crud_app/server"
 
 	"github.com/gorilla/mux"
 )
 
 type Movie struct {
-	ID       string    `json:"id"`
-	Isbn     string    `json:"isbn"`
-	Title    string    `json:"string"`
-	Director *Director `json:"director"`
+	ID         string     `json:"id"`
+	Isbn       string     `json:"isbn" validate:"required,isbn"`
+	Title      string     `json:"title" validate:"required,max=200"`
+	DirectorID string     `json:"director_id"`
+	Director   *Director  `json:"director,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	DeletedAt  *time.Time `json:"deleted_at,omitempty"`
+	Version    int64      `json:"version"`
 }
 
 type Director struct {
-	Firstname string `json:"firstname"`
-	Lastname  string `json:"lastname"`
+	ID        string `json:"id,omitempty"`
+	Firstname string `json:"firstname" validate:"required,max=100"`
+	Lastname  string `json:"lastname" validate:"required,max=100"`
 }
 
-var movies []Movie
+// store holds every movie served by the API.
+// It is chosen in main() based on the -store flag.
+var store MovieStore
+
+// movieIDs names newly created movies (-ids flag).
+var movieIDs IDGenerator
+
+// maxIDAttempts bounds how often createMovie draws a new ID
+// when the generated one is already taken.
+const maxIDAttempts = 5
 
 func getMovies(w http.ResponseWriter, r *http.Request) {
-	// Set the Request Headers
-	w.Header().Set("Content-Type", "appication/json")
+	query, err := parseMovieQuery(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+
+	list := store.List
+	if includeDeleted(r) {
+		list = trash.ListAll
+	}
+	movies, err := list(r.Context())
+	if err == nil {
+		err = expandDirectors(r.Context(), movies)
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	page, next := query.apply(movies)
+	if next != "" {
+		w.Header().Set("Link", nextLink(r, next))
+	}
 
 	// Encode the response into JSON
-	json.NewEncoder(w).Encode(movies)
+	writeJSON(w, http.StatusOK, presentMovies(r, page, next))
 }
 
 func deleteMovie(w http.ResponseWriter, r *http.Request) {
 
-	w.Header().Set("Content-Type", "application/json")
-
 	// Fetch the params of the API
 	params := mux.Vars(r)
 
-	for index, item := range movies {
-		if item.ID == params["id"] {
-			// We can use append() and basic slice operation
-			// to get rid of the movie to be deleted.
-			movies = append(movies[:index], movies[index+1:]...)
-			break
-		}
+	current, err := store.Get(r.Context(), params["id"])
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	version, ok := checkIfMatch(w, r, current)
+	if !ok {
+		return
 	}
 
-	// Return the remaining slice of movies
-	json.NewEncoder(w).Encode(movies)
+	if err := store.Delete(r.Context(), params["id"], version); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	// Nothing left to return
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func getMovie(w http.ResponseWriter, r *http.Request) {
 
-	w.Header().Set("Content-Type", "application/json")
-
 	params := mux.Vars(r)
 
-	// We don't need index this time.
-	for _, item := range movies {
-		if item.ID == params["id"] {
-			json.NewEncoder(w).Encode(item)
-			return
-		}
+	movie, err := store.Get(r.Context(), params["id"])
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag(r, movie))
+	if notModified(r, movie) {
+		w.WriteHeader(http.StatusNotModified)
+		return
 	}
+	writeJSON(w, http.StatusOK, presentMovie(r, movie))
 }
 
 func createMovie(w http.ResponseWriter, r *http.Request) {
 
-	w.Header().Set("Content-Type", "application/json")
-
-	var movie Movie
-
 	// We have the request in JSON format
 	// We simply decode it and populate
 	// our movie variable.
-	_ = json.NewDecoder(r.Body).Decode(&movie)
+	movie, ok := decodeMovie(w, r)
+	if !ok {
+		return
+	}
 
-	movie.ID = strconv.Itoa(rand.Intn(10000000))
+	directorRefs.RLock()
+	defer directorRefs.RUnlock()
+	if !linkDirector(w, r, &movie) {
+		return
+	}
 
-	// append this movie into movies list
-	movies = append(movies, movie)
+	// save this movie into the store under a fresh ID.
+	movie.ID = ""
+	movie, err := insertMovie(r.Context(), movie)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
 
 	// return the newly created movie
-	json.NewEncoder(w).Encode(movie)
+	w.Header().Set("Location", apiPrefix(r)+"/movies/"+movie.ID)
+	w.Header().Set("ETag", etag(r, movie))
+	writeJSON(w, http.StatusCreated, presentMovie(r, movie))
 }
 
-func updateMovie(w http.ResponseWriter, r *http.Request) {
+// insertMovie stores a new movie. Movies without an ID get a
+// fresh one; the store rejects duplicates, so a collision just
+// means we try again. Movies keeping their ID (imports, restores)
+// move the generator past it, so it is not handed out later.
+func insertMovie(ctx context.Context, movie Movie) (Movie, error) {
+	if movie.ID != "" {
+		observeID(movieIDs, movie.ID)
+		return store.Create(ctx, movie)
+	}
+	var err error
+	for attempt := 0; attempt < maxIDAttempts; attempt++ {
+		movie.ID = movieIDs.NewID()
+		var created Movie
+		created, err = store.Create(ctx, movie)
+		if !errors.Is(err, ErrMovieExists) {
+			return created, err
+		}
+		log.Printf("movie ID %s is taken, retrying", movie.ID)
+	}
+	return Movie{}, err
+}
 
-	w.Header().Set("Content-Type", "application/json")
+func updateMovie(w http.ResponseWriter, r *http.Request) {
 
 	// ID is passed in the params
 	params := mux.Vars(r)
 
-	var movie Movie
+	current, err := store.Get(r.Context(), params["id"])
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	version, ok := checkIfMatch(w, r, current)
+	if !ok {
+		return
+	}
 
 	// We'll use JSON decoder to decode the
 	// request body into a movie type.
-	_ = json.NewDecoder(r.Body).Decode(&movie)
-
-	for index, item := range movies {
-		if item.ID == params["id"] {
-			// Remove the old movie from the slice
-			movies = append(movies[:index], movies[index+1:]...)
-			// Set the ID for the updated movie
-			movie.ID = params["id"]
-			// Append the updated movie to the slice
-			movies = append(movies, movie)
-			break
-		}
+	movie, ok := decodeMovie(w, r)
+	if !ok {
+		return
+	}
+
+	directorRefs.RLock()
+	defer directorRefs.RUnlock()
+	if !linkDirector(w, r, &movie) {
+		return
+	}
+
+	movie.Version = version
+	movie, err = store.Update(r.Context(), params["id"], movie)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
 	}
 
-	json.NewEncoder(w).Encode(movies)
+	w.Header().Set("ETag", etag(r, movie))
+	writeJSON(w, http.StatusOK, presentMovie(r, movie))
 }
 
 func main() {
 
+	storeKind := flag.String("store", "memory", "storage backend: memory or file")
+	maxMovies := flag.Int("max-movies", 0, "maximum number of stored movies, trashed ones included (0: no limit)")
+	flag.Var(rateLimits[limitRead], "rate-read", "per-client limit of read requests, e.g. 600/m (0: no limit)")
+	flag.Var(rateLimits[limitWrite], "rate-write", "per-client limit of write requests")
+	flag.Var(rateLimits[limitImport], "rate-import", "per-client limit of bulk imports")
+	retention := flag.Duration("trash-retention", 30*24*time.Hour, "how long deleted movies stay in the trash")
+	purgeInterval := flag.Duration("purge-interval", time.Hour, "how often expired movies are purged from the trash")
+	dataPath := flag.String("data", "movies.jsonl", "path of the movie journal used by -store=file")
+	directorsPath := flag.String("directors-data", "directors.jsonl", "path of the director journal used by -store=file")
+	auditPath := flag.String("audit-data", "audit.jsonl", "path of the movie history journal used by -store=file")
+	webhooksPath := flag.String("webhooks-data", "webhooks.jsonl", "path of the webhook journal used by -store=file")
+	flag.IntVar(&webhookAttempts, "webhook-attempts", webhookAttempts, "how often a webhook delivery is tried before it is dead-lettered")
+	idKind := flag.String("ids", "counter", "ID generator: counter, uuidv7 or ulid")
+	flag.StringVar(&directorDeletePolicy, "director-delete", directorDeletePolicy,
+		"what deleting a director with movies does: reject or cascade")
+	secret := flag.String("jwt-secret", os.Getenv("CRUD_APP_JWT_SECRET"),
+		"HMAC secret for bearer tokens, required unless -insecure-no-auth is set (env CRUD_APP_JWT_SECRET)")
+	flag.BoolVar(&authDisabled, "insecure-no-auth", false,
+		"disable authentication and treat every request as an admin's; for local development only")
+	issueRole := flag.String("issue-token", "", "print a token for the given role (viewer, editor, admin) and exit")
+	tokenSubject := flag.String("token-subject", "cli", "subject of the token printed by -issue-token")
+	tokenTTL := flag.Duration("token-ttl", 24*time.Hour, "lifetime of the token printed by -issue-token")
+	flag.Var(&maxBodySize, "max-body", "maximum size of request bodies, e.g. 512KiB or 2MB")
+	flag.Var(&maxImportSize, "max-import", "maximum size of a bulk import body")
+	cfg := server.Defaults(":8000")
+	if err := cfg.RegisterFlags(flag.CommandLine, "CRUD_APP"); err != nil {
+		log.Fatal(err)
+	}
+	flag.Parse()
+
+	jwtSecret = []byte(*secret)
+	if *issueRole != "" {
+		if len(jwtSecret) == 0 {
+			log.Fatal("-issue-token needs -jwt-secret")
+		}
+		token, err := issueToken(*tokenSubject, *issueRole, *tokenTTL, time.Now())
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(token)
+		return
+	}
+	switch {
+	case authDisabled:
+		log.Println("Warning: -insecure-no-auth is set, authentication is disabled")
+	case len(jwtSecret) == 0:
+		log.Fatal("-jwt-secret is required; pass -insecure-no-auth to run without authentication")
+	}
+
+	if *purgeInterval <= 0 {
+		log.Fatal("-purge-interval must be positive")
+	}
+	if webhookAttempts < 1 {
+		log.Fatal("-webhook-attempts must be at least 1")
+	}
+	if directorDeletePolicy != "reject" && directorDeletePolicy != "cascade" {
+		log.Fatalf("unknown -director-delete %q (want reject or cascade)", directorDeletePolicy)
+	}
+
+	teardown, err := setup(options{
+		store:         *storeKind,
+		dataPath:      *dataPath,
+		directorsPath: *directorsPath,
+		auditPath:     *auditPath,
+		webhooksPath:  *webhooksPath,
+		ids:           *idKind,
+		maxMovies:     *maxMovies,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer teardown()
+
+	cfg.OnShutdown = func() {
+		changes.close()
+		live.closeAll()
+	}
+
+	stopPurger := startPurger(*retention, *purgeInterval)
+	defer stopPurger()
+
+	r := newRouter()
+
+	fmt.Printf("Starting server at %s\n", cfg.Addr)
+
+	// Create a web server. Run returns once a shutdown signal
+	// was received and the in-flight requests have drained. The
+	// live connections get a moment to say goodbye, after which
+	// the deferred Close calls release the stores.
+	if err := server.Run(context.Background(), cfg, r); err != nil {
+		log.Fatal(err)
+	}
+	live.wait(liveCloseGrace)
+}
+
+// options are the settings setup takes from the command line.
+type options struct {
+	store         string // memory or file
+	dataPath      string
+	directorsPath string
+	auditPath     string
+	webhooksPath  string
+	ids           string
+	maxMovies     int
+}
+
+// setup opens the stores, seeds and indexes them, and hooks up
+// everything that follows their changes: the history, the search
+// index, the event stream, the live channel and the webhooks.
+// The results go into the package-level variables the handlers
+// use, so main and the tests run the same application.
+// teardown stops the webhook deliveries and closes the stores.
+func setup(opts options) (teardown func(), err error) {
+	var closers []func() error
+	closeAll := func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			if err := closers[i](); err != nil {
+				log.Println("Error: closing:", err)
+			}
+		}
+	}
+	defer func() {
+		if err != nil {
+			closeAll()
+		}
+	}()
+
+	switch opts.store {
+	case "memory":
+		ms := newMemoryStore()
+		ms.maxMovies = opts.maxMovies
+		store = ms
+		directors = newMemoryDirectorStore()
+	case "file":
+		fs, err := newFileStore(opts.dataPath)
+		if err != nil {
+			return nil, err
+		}
+		closers = append(closers, fs.Close)
+		fs.maxMovies = opts.maxMovies
+		store = fs
+
+		ds, err := newFileDirectorStore(opts.directorsPath)
+		if err != nil {
+			return nil, err
+		}
+		closers = append(closers, ds.Close)
+		directors = ds
+	default:
+		return nil, fmt.Errorf("unknown -store %q (want memory or file)", opts.store)
+	}
+
+	movieEvents = observe(store)
+	trash = newTrashStore(movieEvents)
+	store = trash
+
+	// The history and the webhooks are only persisted
+	// along with the movies.
+	auditFile, webhooksFile := "", ""
+	if opts.store == "file" {
+		auditFile, webhooksFile = opts.auditPath, opts.webhooksPath
+	}
+	if audit, err = newAuditLog(auditFile); err != nil {
+		return nil, err
+	}
+	closers = append(closers, audit.Close)
+	movieEvents.subscribe(audit.onMovieEvent)
+
+	if webhooks, err = newWebhookDispatcher(webhooksFile); err != nil {
+		return nil, err
+	}
+	closers = append(closers, webhooks.Close)
+
+	ctx := context.Background()
+	if err = seedMovies(ctx); err != nil {
+		return nil, err
+	}
+	if movieIDs, directorIDs, err = newIDGenerators(ctx, opts.ids); err != nil {
+		return nil, err
+	}
+	if err = migrateDirectors(ctx); err != nil {
+		return nil, err
+	}
+
+	searchIdx = newSearchIndex()
+	if err = startSearch(ctx); err != nil {
+		return nil, err
+	}
+	changes = newBroker()
+	live = newLiveHub()
+	movieEvents.subscribe(changes.onMovieEvent)
+	movieEvents.subscribe(live.onMovieEvent)
+	movieEvents.subscribe(webhooks.onMovieEvent)
+	webhooks.start()
+
+	return closeAll, nil
+}
+
+// newRouter builds the complete HTTP handler of the API:
+// every route, wrapped in the middlewares. It only relies on
+// the package-level stores and settings, which main sets up
+// before calling it.
+func newRouter() *mux.Router {
 	r := mux.NewRouter()
+	r.Use(middlewares...)
+	r.NotFoundHandler = withMiddlewares(http.HandlerFunc(notFound))
+	r.MethodNotAllowedHandler = withMiddlewares(http.HandlerFunc(methodNotAllowed))
+
+	// Viewers may read, only editors and admins may write.
+	// Webhooks are for admins only.
+	read := requirePermission(canReadMovies)
+	write := requirePermission(canWriteMovies)
+	admin := requirePermission(isAdmin)
+
+	// "" is the legacy unversioned API, served like v1.
+	for _, prefix := range []string{"", "/v1", "/v2"} {
+		r.HandleFunc(prefix+"/movies:export", read(exportMovies)).Methods("GET")
+		r.HandleFunc(prefix+"/movies:import", write(importMovies)).Methods("POST").Name("importMovies")
+		r.HandleFunc(prefix+"/movies", read(getMovies)).Methods("GET")
+		r.HandleFunc(prefix+"/movies/search", read(searchMovies)).Methods("GET")
+		r.HandleFunc(prefix+"/movies/events", read(streamMovieEvents)).Methods("GET").Name("streamMovieEvents")
+		r.HandleFunc(prefix+"/movies/{id}", read(getMovie)).Methods("GET")
+		r.HandleFunc(prefix+"/movies", write(createMovie)).Methods("POST")
+		r.HandleFunc(prefix+"/movies/{id}", write(updateMovie)).Methods("PUT")
+		r.HandleFunc(prefix+"/movies/{id}", write(patchMovie)).Methods("PATCH")
+		r.HandleFunc(prefix+"/movies/{id}", write(deleteMovie)).Methods("DELETE")
+		r.HandleFunc(prefix+"/movies/{id}:undelete", write(undeleteMovie)).Methods("POST")
+		r.HandleFunc(prefix+"/movies/{id}/history", read(getMovieHistory)).Methods("GET")
+		r.HandleFunc(prefix+"/movies/{id}/live", read(liveMovie)).Methods("GET").Name("liveMovie")
+		r.HandleFunc(prefix+"/movies/{id}/restore", write(restoreMovie)).Methods("POST")
+
+		r.HandleFunc(prefix+"/directors", read(getDirectors)).Methods("GET")
+		r.HandleFunc(prefix+"/directors/{id}", read(getDirector)).Methods("GET")
+		r.HandleFunc(prefix+"/directors/{id}/movies", read(getDirectorMovies)).Methods("GET")
+		r.HandleFunc(prefix+"/directors", write(createDirector)).Methods("POST")
+		r.HandleFunc(prefix+"/directors/{id}", write(updateDirector)).Methods("PUT")
+		r.HandleFunc(prefix+"/directors/{id}", write(deleteDirector)).Methods("DELETE")
+
+		r.HandleFunc(prefix+"/webhooks", admin(getWebhooks)).Methods("GET")
+		r.HandleFunc(prefix+"/webhooks", admin(createWebhook)).Methods("POST")
+		r.HandleFunc(prefix+"/webhooks/{id}", admin(getWebhook)).Methods("GET")
+		r.HandleFunc(prefix+"/webhooks/{id}", admin(deleteWebhook)).Methods("DELETE")
+		r.HandleFunc(prefix+"/webhooks/{id}/deliveries", admin(getWebhookDeliveries)).Methods("GET")
+		r.HandleFunc(prefix+"/webhooks/{id}/deliveries/{delivery}:retry", admin(retryWebhookDelivery)).Methods("POST")
+	}
+
+	// The spec is public, so client generators can fetch it.
+	r.HandleFunc("/openapi.json", getOpenAPISpec).Methods("GET")
+
+	return r
+}
 
-	movies = append(
-		movies,
-		Movie{ID: "1", Isbn: "438227", Title: "Movie One", Director: &Director{Firstname: "John", Lastname: "Doe"}},
-		Movie{ID: "2", Isbn: "454556", Title: "Movie Two", Director: &Director{Firstname: "Steve", Lastname: "Smith"}},
-	)
+// newIDGenerators builds the movie and director ID generators,
+// starting the counters after the IDs already in use.
+func newIDGenerators(ctx context.Context, kind string) (IDGenerator, IDGenerator, error) {
+	movies, err := trash.ListAll(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	ids := make([]string, len(movies))
+	for i, movie := range movies {
+		ids[i] = movie.ID
+	}
+	forMovies, err := newIDGenerator(kind, ids)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	r.HandleFunc("/movies", getMovies).Methods("GET")
-	r.HandleFunc("/movies/{id}", getMovie).Methods("GET")
-	r.HandleFunc("/movies", createMovie).Methods("POST")
-	r.HandleFunc("/movies/{id}", updateMovie).Methods("PUT")
-	r.HandleFunc("/movies/{id}", deleteMovie).Methods("DELETE")
+	people, err := directors.List(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	ids = make([]string, len(people))
+	for i, director := range people {
+		ids[i] = director.ID
+	}
+	forDirectors, err := newIDGenerator(kind, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	return forMovies, forDirectors, nil
+}
 
-	fmt.Printf("Starting server at port 8000\n")
+// seedMovies adds the sample movies and their directors
+// to an empty store. A persistent store that already has
+// data is left untouched.
+func seedMovies(ctx context.Context) error {
+	movies, err := trash.ListAll(ctx)
+	if err != nil || len(movies) > 0 {
+		return err
+	}
 
-	// Create a web server
-	log.Fatal(http.ListenAndServe(":8000", r))
+	for _, director := range []Director{
+		{ID: "1", Firstname: "John", Lastname: "Doe"},
+		{ID: "2", Firstname: "Steve", Lastname: "Smith"},
+	} {
+		if _, err := directors.Create(ctx, director); err != nil && !errors.Is(err, ErrDirectorExists) {
+			return err
+		}
+	}
 
+	for _, movie := range []Movie{
+		{ID: "1", Isbn: "0306406152", Title: "Movie One", DirectorID: "1"},
+		{ID: "2", Isbn: "9783161484100", Title: "Movie Two", DirectorID: "2"},
+	} {
+		if _, err := store.Create(ctx, movie); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// newTestRouter sets up the application on fresh in-memory
+// stores holding the two sample movies, with authentication
+// and rate limits off, and returns its router. The handlers
+// share package-level state, so tests using it must not run
+// in parallel.
+func newTestRouter(t *testing.T) *mux.Router {
+	t.Helper()
+
+	jwtSecret, authDisabled = nil, true
+	for _, limit := range rateLimits {
+		*limit = rate{}
+	}
+	teardown, err := setup(options{store: "memory", ids: "counter"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(teardown)
+	return newRouter()
+}
+
+// do sends a request through h. header holds name, value pairs;
+// bodies are sent as JSON unless a Content-Type is given.
+func do(t *testing.T, h http.Handler, method, path, body string, header ...string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// decode unmarshals the body of rec into a T.
+func decode[T any](t *testing.T, rec *httptest.ResponseRecorder) T {
+	t.Helper()
+
+	var v T
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body.String(), err)
+	}
+	return v
+}
+
+const newMovieV2 = `{"isbn": "9780306406157", "title": "New", "director_id": "1"}`
+
+// routeTest is one request against a fresh router and the
+// status it must get.
+type routeTest struct {
+	name   string
+	method string
+	path   string
+	body   string
+	header []string
+	want   int
+}
+
+// routeTests covers every route. openapi_test.go replays them to
+// compare the responses with the spec.
+var routeTests = []routeTest{
+	{"list movies", "GET", "/v2/movies", "", nil, 200},
+	{"list movies v1", "GET", "/movies", "", nil, 200},
+	{"list movies bad limit", "GET", "/v2/movies?limit=0", "", nil, 400},
+	{"get movie", "GET", "/v2/movies/1", "", nil, 200},
+	{"get movie v1", "GET", "/v1/movies/1", "", nil, 200},
+	{"get movie with bare version tag", "GET", "/v2/movies/1", "", []string{"If-None-Match", `"1"`}, 200},
+	{"get missing movie", "GET", "/v2/movies/404", "", nil, 404},
+	{"create movie", "POST", "/v2/movies", newMovieV2, nil, 201},
+	{"create movie v1", "POST", "/v1/movies",
+		`{"isbn": "9780306406157", "string": "New", "director": {"firstname": "Jane", "lastname": "Roe"}}`, nil, 201},
+	{"create malformed JSON", "POST", "/v2/movies", `{"isbn":`, nil, 400},
+	{"create empty body", "POST", "/v2/movies", "", nil, 400},
+	{"create invalid movie", "POST", "/v2/movies", `{"isbn": "123", "title": ""}`, nil, 422},
+	{"create with unknown director", "POST", "/v2/movies",
+		`{"isbn": "9780306406157", "title": "New", "director_id": "99"}`, nil, 422},
+	{"replace movie", "PUT", "/v2/movies/1", newMovieV2, nil, 200},
+	{"replace missing movie", "PUT", "/v2/movies/404", newMovieV2, nil, 404},
+	{"replace malformed JSON", "PUT", "/v2/movies/1", `{`, nil, 400},
+	{"replace with stale If-Match", "PUT", "/v2/movies/1", newMovieV2, []string{"If-Match", `"99"`}, 412},
+	{"patch movie", "PATCH", "/v2/movies/1", `{"title": "Patched"}`,
+		[]string{"Content-Type", mergePatchType}, 200},
+	{"patch malformed JSON", "PATCH", "/v2/movies/1", `{"title":`, []string{"Content-Type", mergePatchType}, 400},
+	{"patch wrong media type", "PATCH", "/v2/movies/1", `{}`, []string{"Content-Type", "text/plain"}, 415},
+	{"patch missing movie", "PATCH", "/v2/movies/404", `{}`, []string{"Content-Type", mergePatchType}, 404},
+	{"delete movie", "DELETE", "/v2/movies/2", "", nil, 204},
+	{"delete missing movie", "DELETE", "/v2/movies/404", "", nil, 404},
+	{"delete with stale If-Match", "DELETE", "/v2/movies/2", "", []string{"If-Match", `"99"`}, 412},
+	{"undelete live movie", "POST", "/v2/movies/1:undelete", "", nil, 409},
+	{"undelete missing movie", "POST", "/v2/movies/404:undelete", "", nil, 404},
+	{"history", "GET", "/v2/movies/1/history", "", nil, 200},
+	{"history of missing movie", "GET", "/v2/movies/404/history", "", nil, 404},
+	{"restore", "POST", "/v2/movies/1/restore?rev=1", "", nil, 200},
+	{"restore without rev", "POST", "/v2/movies/1/restore", "", nil, 400},
+	{"restore unknown rev", "POST", "/v2/movies/1/restore?rev=99", "", nil, 404},
+	{"search", "GET", "/v2/movies/search?q=movie", "", nil, 200},
+	{"search without words", "GET", "/v2/movies/search?q=+", "", nil, 400},
+	{"events with bad Last-Event-ID", "GET", "/v2/movies/events", "", []string{"Last-Event-ID", "x"}, 400},
+	{"live without upgrade", "GET", "/v2/movies/1/live", "", nil, 426},
+	{"live on missing movie", "GET", "/v2/movies/404/live", "", nil, 404},
+	{"export", "GET", "/v2/movies:export?format=csv", "", nil, 200},
+	{"export unknown format", "GET", "/v2/movies:export?format=xml", "", nil, 400},
+	{"import", "POST", "/v2/movies:import", `[` + newMovieV2 + `]`, nil, 200},
+	{"import malformed JSON", "POST", "/v2/movies:import", `[{`, nil, 400},
+
+	{"list directors", "GET", "/v2/directors", "", nil, 200},
+	{"get director", "GET", "/v2/directors/1", "", nil, 200},
+	{"get missing director", "GET", "/v2/directors/404", "", nil, 404},
+	{"director's movies", "GET", "/v2/directors/1/movies", "", nil, 200},
+	{"movies of missing director", "GET", "/v2/directors/404/movies", "", nil, 404},
+	{"create director", "POST", "/v2/directors", `{"firstname": "Jane", "lastname": "Roe"}`, nil, 201},
+	{"create director malformed JSON", "POST", "/v2/directors", `{"firstname"`, nil, 400},
+	{"create invalid director", "POST", "/v2/directors", `{}`, nil, 422},
+	{"replace director", "PUT", "/v2/directors/1", `{"firstname": "Jane", "lastname": "Roe"}`, nil, 200},
+	{"replace missing director", "PUT", "/v2/directors/404", `{"firstname": "Jane", "lastname": "Roe"}`, nil, 404},
+	{"delete referenced director", "DELETE", "/v2/directors/1", "", nil, 409},
+	{"delete missing director", "DELETE", "/v2/directors/404", "", nil, 404},
+
+	{"list webhooks", "GET", "/v2/webhooks", "", nil, 200},
+	{"create webhook", "POST", "/v2/webhooks", `{"url": "http://127.0.0.1:1/", "events": ["movie.created"]}`, nil, 201},
+	{"create invalid webhook", "POST", "/v2/webhooks", `{"url": "ftp://x", "events": []}`, nil, 422},
+	{"get missing webhook", "GET", "/v2/webhooks/404", "", nil, 404},
+	{"delete missing webhook", "DELETE", "/v2/webhooks/404", "", nil, 404},
+	{"deliveries of missing webhook", "GET", "/v2/webhooks/404/deliveries", "", nil, 404},
+	{"retry on missing webhook", "POST", "/v2/webhooks/404/deliveries/1:retry", "", nil, 404},
+
+	{"openapi", "GET", "/openapi.json", "", nil, 200},
+	{"unknown route", "GET", "/v2/nope", "", nil, 404},
+	{"method not allowed", "PUT", "/v2/movies", "", nil, 405},
+}
+
+func TestRoutes(t *testing.T) {
+	for _, tt := range routeTests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestRouter(t)
+			rec := do(t, h, tt.method, tt.path, tt.body, tt.header...)
+			if rec.Code != tt.want {
+				t.Fatalf("%s %s = %d, want %d: %s", tt.method, tt.path, rec.Code, tt.want, rec.Body)
+			}
+			if rec.Code >= 400 {
+				// Every error uses the envelope.
+				if env := decode[errorEnvelope](t, rec); env.Error.Code == "" {
+					t.Errorf("error response without code: %s", rec.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestMovieLifecycle(t *testing.T) {
+	h := newTestRouter(t)
+
+	rec := do(t, h, "POST", "/v2/movies", newMovieV2)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create = %d: %s", rec.Code, rec.Body)
+	}
+	created := decode[Movie](t, rec)
+	location := rec.Header().Get("Location")
+	if location != "/v2/movies/"+created.ID {
+		t.Errorf("Location = %q, want /v2/movies/%s", location, created.ID)
+	}
+	if created.Version != 1 || created.Director == nil || created.Director.Firstname != "John" {
+		t.Errorf("created = %+v, want version 1 and director John", created)
+	}
+
+	rec = do(t, h, "PATCH", location, `{"title": "Renamed"}`,
+		"Content-Type", mergePatchType, "If-Match", rec.Header().Get("ETag"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("patch = %d: %s", rec.Code, rec.Body)
+	}
+	if patched := decode[Movie](t, rec); patched.Title != "Renamed" || patched.Isbn != created.Isbn || patched.Version != 2 {
+		t.Errorf("patched = %+v, want the new title, the old ISBN and version 2", patched)
+	}
+
+	if rec = do(t, h, "DELETE", location, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete = %d: %s", rec.Code, rec.Body)
+	}
+	if rec = do(t, h, "GET", location, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("get after delete = %d, want 404", rec.Code)
+	}
+	if rec = do(t, h, "POST", location+":undelete", ""); rec.Code != http.StatusOK {
+		t.Fatalf("undelete = %d: %s", rec.Code, rec.Body)
+	}
+
+	history := decode[revisionList](t, do(t, h, "GET", location+"/history", ""))
+	var ops []string
+	for _, rev := range history.Data {
+		ops = append(ops, rev.Op)
+	}
+	if got := strings.Join(ops, ","); got != "create,update,trash,undelete" {
+		t.Errorf("history ops = %s, want create,update,trash,undelete", got)
+	}
+}
+
+func TestDeleteDirector(t *testing.T) {
+	h := newTestRouter(t)
+
+	// Under reject, a trashed movie still holds on to its director.
+	if rec := do(t, h, "DELETE", "/v2/movies/2", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete movie = %d: %s", rec.Code, rec.Body)
+	}
+	if rec := do(t, h, "DELETE", "/v2/directors/2", ""); rec.Code != http.StatusConflict {
+		t.Fatalf("delete director with a trashed movie = %d, want 409: %s", rec.Code, rec.Body)
+	}
+	if rec := do(t, h, "POST", "/v2/movies/2:undelete", ""); rec.Code != http.StatusOK {
+		t.Errorf("undelete after the refused delete = %d: %s", rec.Code, rec.Body)
+	}
+
+	saved := directorDeletePolicy
+	directorDeletePolicy = "cascade"
+	t.Cleanup(func() { directorDeletePolicy = saved })
+
+	if rec := do(t, h, "DELETE", "/v2/movies/2", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete movie = %d: %s", rec.Code, rec.Body)
+	}
+	if rec := do(t, h, "DELETE", "/v2/directors/1", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("cascading delete = %d: %s", rec.Code, rec.Body)
+	}
+	if rec := do(t, h, "DELETE", "/v2/directors/2", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("cascading delete with a trashed movie = %d: %s", rec.Code, rec.Body)
+	}
+	for _, id := range []string{"1", "2"} {
+		if rec := do(t, h, "POST", "/v2/movies/"+id+":undelete", ""); rec.Code != http.StatusNotFound {
+			t.Errorf("undelete of movie %s after the cascade = %d, want 404", id, rec.Code)
+		}
+	}
+}
+
+// TestConcurrentUpdates races writes conditioned on the same
+// ETag: exactly one may win, the others must be told they
+// are stale.
+func TestConcurrentUpdates(t *testing.T) {
+	h := newTestRouter(t)
+	tag := do(t, h, "GET", "/v2/movies/1", "").Header().Get("ETag")
+
+	const writers = 20
+	codes := make(chan int, writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"isbn": "0306406152", "title": "Take %d", "director_id": "1"}`, i)
+			codes <- do(t, h, "PUT", "/v2/movies/1", body, "If-Match", tag).Code
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+
+	counts := map[int]int{}
+	for code := range codes {
+		counts[code]++
+	}
+	if counts[http.StatusOK] != 1 || counts[http.StatusPreconditionFailed] != writers-1 {
+		t.Errorf("statuses = %v, want one 200 and %d 412", counts, writers-1)
+	}
+	if movie := decode[Movie](t, do(t, h, "GET", "/v2/movies/1", "")); movie.Version != 2 {
+		t.Errorf("version = %d, want 2", movie.Version)
+	}
+}
+
+// TestConcurrentPatches checks that unconditional patches racing
+// each other are either applied or rejected with 409, never lost.
+func TestConcurrentPatches(t *testing.T) {
+	h := newTestRouter(t)
+
+	const writers = 20
+	codes := make(chan int, writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"title": "Take %d"}`, i)
+			codes <- do(t, h, "PATCH", "/v2/movies/1", body, "Content-Type", mergePatchType).Code
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+
+	applied := 0
+	for code := range codes {
+		switch code {
+		case http.StatusOK:
+			applied++
+		case http.StatusConflict:
+		default:
+			t.Errorf("status %d, want 200 or 409", code)
+		}
+	}
+	movie := decode[Movie](t, do(t, h, "GET", "/v2/movies/1", ""))
+	if movie.Version != int64(applied)+1 {
+		t.Errorf("version = %d after %d applied patches, want %d", movie.Version, applied, applied+1)
+	}
+}
+
+func TestMovieEvents(t *testing.T) {
+	h := newTestRouter(t)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/v2/movies/events", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	if rec := do(t, h, "POST", "/v2/movies", newMovieV2); rec.Code != http.StatusCreated {
+		t.Fatalf("create = %d: %s", rec.Code, rec.Body)
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() && scanner.Text() != "" {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) != 3 || lines[0] != "id: 1" || lines[1] != "event: create" || !strings.Contains(lines[2], `"title":"New"`) {
+		t.Errorf("event = %q, want id 1, event create and the new movie", lines)
+	}
+}
+
+// TestConcurrentRequests runs the five movie routes side by side;
+// run it with -race. Every created movie must show up in the list
+// unless it was deleted again.
+func TestConcurrentRequests(t *testing.T) {
+	h := newTestRouter(t)
+
+	const workers, rounds = 8, 10
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				rec := do(t, h, "POST", "/v2/movies", newMovieV2)
+				if rec.Code != http.StatusCreated {
+					t.Errorf("create = %d: %s", rec.Code, rec.Body)
+					return
+				}
+				location := rec.Header().Get("Location")
+				if rec := do(t, h, "PUT", location, newMovieV2); rec.Code != http.StatusOK {
+					t.Errorf("replace = %d: %s", rec.Code, rec.Body)
+				}
+				if rec := do(t, h, "GET", location, ""); rec.Code != http.StatusOK {
+					t.Errorf("get = %d: %s", rec.Code, rec.Body)
+				}
+				if rec := do(t, h, "GET", "/v2/movies?limit=100", ""); rec.Code != http.StatusOK {
+					t.Errorf("list = %d: %s", rec.Code, rec.Body)
+				}
+				if i%2 == 0 {
+					if rec := do(t, h, "DELETE", location, ""); rec.Code != http.StatusNoContent {
+						t.Errorf("delete = %d: %s", rec.Code, rec.Body)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	list := decode[movieList](t, do(t, h, "GET", "/v2/movies?limit=100", ""))
+	if want := 2 + workers*rounds/2; len(list.Data) != want {
+		t.Errorf("%d movies listed, want %d", len(list.Data), want)
+	}
+}
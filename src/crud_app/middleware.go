@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"time"
+
+	"crud_app/bytesize"
+
+	"github.com/gorilla/mux"
+)
+
+// middlewares wrap every route of the router, outermost first:
+//
+//	requestIDs    assign/propagate X-Request-ID
+//	accessLog     one structured log line per request
+//	recoverPanics turn a handler panic into a 500 JSON error
+//	rateLimit     reject clients going over rateLimits with 429
+//	timing        report the handler duration in Server-Timing
+//	limitBody     cap the size of request bodies at maxBodySize
+var middlewares = []mux.MiddlewareFunc{
+	requestIDs,
+	accessLog,
+	recoverPanics,
+	rateLimit,
+	timing,
+	limitBody,
+}
+
+// withMiddlewares applies the stack to a handler that is not
+// a route, such as the router's NotFoundHandler.
+func withMiddlewares(h http.Handler) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	principalKey
+	restoreKey // revision a write restores, see restoreMovie
+)
+
+// requestIDs reuses the caller's X-Request-ID (so a request can be
+// traced across services) or makes one up, stores it in the request
+// context and echoes it in the response.
+func requestIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// accessLogger writes the access log as JSON lines to stderr.
+var accessLogger = slog.New(slog.NewJSONHandler(os.Stderr, nil))
+
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rec, r)
+
+		status := rec.status
+		if status == 0 {
+			// The handler wrote nothing, net/http sends 200.
+			status = http.StatusOK
+		}
+
+		route := ""
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+		accessLogger.LogAttrs(r.Context(), slog.LevelInfo, "request",
+			slog.String("request_id", requestID(w, r)),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("route", route),
+			slog.Int("status", status),
+			slog.Int64("bytes", rec.bytes),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("remote", r.RemoteAddr),
+		)
+	})
+}
+
+// recoverPanics keeps a panicking handler from killing the
+// connection: like panicker() in the defer_panic_recover
+// tutorial, a deferred function recovers, logs the error,
+// and then we gracefully answer with a 500.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					// Deliberate abort, let net/http handle it.
+					panic(err)
+				}
+				log.Printf("Error: panic serving %s %s: %v\n%s", r.Method, r.URL.Path, err, debug.Stack())
+				if rec.status == 0 {
+					writeError(rec, r, http.StatusInternalServerError, codeInternal, "internal server error")
+				}
+			}
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// timing adds a Server-Timing header with the time spent
+// until the handler started writing its response.
+func timing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, beforeHeader: func(h http.Header) {
+			ms := float64(time.Since(start).Microseconds()) / 1000
+			h.Set("Server-Timing", fmt.Sprintf("app;dur=%.3f", ms))
+		}}
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// maxBodySize is the largest request body we read (-max-body flag).
+var maxBodySize = bytesize.MiB
+
+// limitBody makes reads past maxBodySize fail, which decodeJSON
+// reports as 413 Request Entity Too Large. Bulk imports get the
+// larger maxImportSize instead.
+func limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil {
+			limit := maxBodySize
+			if route := mux.CurrentRoute(r); route != nil && route.GetName() == "importMovies" {
+				limit = maxImportSize
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, int64(limit))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// statusRecorder remembers the status and size of a response.
+// beforeHeader, if set, may add headers right before they are sent.
+type statusRecorder struct {
+	http.ResponseWriter
+	status       int
+	bytes        int64
+	beforeHeader func(http.Header)
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status != 0 {
+		// Headers are already on their way.
+		return
+	}
+	rec.status = status
+	if rec.beforeHeader != nil {
+		rec.beforeHeader(rec.Header())
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying
+// writer, e.g. to flush a streaming response.
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Hijack records a taken over connection, such as a WebSocket
+// upgrade, as 101 Switching Protocols.
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(rec.ResponseWriter).Hijack()
+	if err == nil && rec.status == 0 {
+		rec.status = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// movieEvent describes a change made through the MovieStore.
+// For deletes, Movie is the movie as it was before removal.
+type movieEvent struct {
+	Op     string // opCreate, opUpdate or opDelete
+	Movie  Movie
+	Before *Movie // nil for creates
+}
+
+// movieListener is told about every successful write.
+// Listeners run while the store is locked, so they see the
+// events in order; they must be quick and must not write to
+// the store themselves.
+type movieListener func(ctx context.Context, event movieEvent)
+
+// movieEvents wraps store in main(), so features like the
+// search index can follow every change of the collection.
+var movieEvents *observedStore
+
+// observedStore is a MovieStore decorator that reports every
+// write to its listeners. Writes are serialized, which lets it
+// read the previous state of a movie without racing another write.
+type observedStore struct {
+	MovieStore
+	mu        sync.Mutex
+	listeners []movieListener
+}
+
+func observe(s MovieStore) *observedStore {
+	return &observedStore{MovieStore: s}
+}
+
+func (s *observedStore) subscribe(listener movieListener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.listeners = append(s.listeners, listener)
+}
+
+// notify must be called with s.mu held.
+func (s *observedStore) notify(ctx context.Context, event movieEvent) {
+	for _, listener := range s.listeners {
+		listener(ctx, event)
+	}
+}
+
+func (s *observedStore) Create(ctx context.Context, movie Movie) (Movie, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	created, err := s.MovieStore.Create(ctx, movie)
+	if err != nil {
+		return Movie{}, err
+	}
+	s.notify(ctx, movieEvent{Op: opCreate, Movie: created})
+	return created, nil
+}
+
+func (s *observedStore) Update(ctx context.Context, id string, movie Movie) (Movie, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	before, err := s.MovieStore.Get(ctx, id)
+	if err != nil {
+		return Movie{}, err
+	}
+	updated, err := s.MovieStore.Update(ctx, id, movie)
+	if err != nil {
+		return Movie{}, err
+	}
+	s.notify(ctx, movieEvent{Op: opUpdate, Movie: updated, Before: &before})
+	return updated, nil
+}
+
+func (s *observedStore) Delete(ctx context.Context, id string, version int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	before, err := s.MovieStore.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := s.MovieStore.Delete(ctx, id, version); err != nil {
+		return err
+	}
+	s.notify(ctx, movieEvent{Op: opDelete, Movie: before, Before: &before})
+	return nil
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec documents the API for client generators and is
+// served as-is at /openapi.json. It is maintained by hand;
+// openapi_test.go makes sure it keeps matching the code.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+func getOpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// These tests keep openapi.json and the code from drifting apart:
+// every route must be documented, the schemas must list the JSON
+// fields of the Go types, and the responses of routeTests must
+// have a documented status and the documented shape.
+
+// specSchemas pairs every schema of the spec with the Go type
+// it describes, so a renamed or added JSON field is noticed.
+var specSchemas = map[string]any{
+	"Movie":        Movie{},
+	"MovieV1":      movieV1{},
+	"MovieList":    movieList{},
+	"Director":     Director{},
+	"DirectorList": directorList{},
+	"ImportReport": importReport{},
+	"Revision":     revision{},
+	"RevisionList": revisionList{},
+	"Webhook":      webhook{},
+	"WebhookList":  webhookList{},
+	"Delivery":     delivery{},
+	"DeliveryList": deliveryList{},
+	"FieldError":   fieldError{},
+	"Error":        errorEnvelope{},
+}
+
+// spec is the part of an OpenAPI document the tests look at.
+type spec struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas   map[string]specSchema   `json:"schemas"`
+		Responses map[string]specResponse `json:"responses"`
+	} `json:"components"`
+}
+
+type specSchema struct {
+	Ref        string                `json:"$ref"`
+	Type       string                `json:"type"`
+	Properties map[string]specSchema `json:"properties"`
+	Items      *specSchema           `json:"items"`
+	Required   []string              `json:"required"`
+	Enum       []any                 `json:"enum"`
+}
+
+type specOperation struct {
+	Responses map[string]specResponse `json:"responses"`
+}
+
+type specResponse struct {
+	Ref     string `json:"$ref"`
+	Content map[string]struct {
+		Schema specSchema `json:"schema"`
+	} `json:"content"`
+}
+
+func loadSpec(t *testing.T) *spec {
+	t.Helper()
+
+	var doc spec
+	if err := json.Unmarshal(openAPISpec, &doc); err != nil {
+		t.Fatalf("openapi.json: %v", err)
+	}
+	return &doc
+}
+
+// TestSpecRoutes checks that every route is documented and every
+// documented operation is routed. The versions share their paths.
+func TestSpecRoutes(t *testing.T) {
+	doc := loadSpec(t)
+
+	documented := map[string]bool{}
+	for path, item := range doc.Paths {
+		for method := range item {
+			if method != "parameters" {
+				documented[strings.ToUpper(method)+" "+path] = true
+			}
+		}
+	}
+	routed := map[string]bool{}
+	var problems []string
+	err := newRouter().Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || path == "/openapi.json" {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, prefix := range []string{"/v1", "/v2"} {
+			path = strings.TrimPrefix(path, prefix)
+		}
+		for _, method := range methods {
+			op := method + " " + path
+			if !documented[op] && !routed[op] {
+				problems = append(problems, op+" is not documented")
+			}
+			routed[op] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for op := range documented {
+		if !routed[op] {
+			problems = append(problems, op+" is documented but not routed")
+		}
+	}
+	reportProblems(t, problems)
+}
+
+func TestSpecSchemas(t *testing.T) {
+	doc := loadSpec(t)
+
+	var problems []string
+	for name, v := range specSchemas {
+		schema, ok := doc.Components.Schemas[name]
+		if !ok {
+			problems = append(problems, "schema "+name+" is missing")
+			continue
+		}
+		problems = append(problems, compareSchema(name, schema, reflect.TypeOf(v))...)
+	}
+	reportProblems(t, problems)
+}
+
+// TestSpecResponses replays routeTests and checks each v2 response
+// against the operation it hit: the status code must be documented
+// and a JSON body must have the documented shape.
+func TestSpecResponses(t *testing.T) {
+	doc := loadSpec(t)
+
+	for _, tt := range routeTests {
+		if !strings.HasPrefix(tt.path, "/v2/") {
+			// v1 and the root serve the legacy shapes.
+			continue
+		}
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRouter(t)
+			rec := do(t, r, tt.method, tt.path, tt.body, tt.header...)
+
+			var match mux.RouteMatch
+			if !r.Match(httptest.NewRequest(tt.method, tt.path, nil), &match) || match.Route == nil {
+				// Unknown paths and methods are not operations.
+				return
+			}
+			path, _ := match.Route.GetPathTemplate()
+			reportProblems(t, doc.checkResponse(strings.TrimPrefix(path, "/v2"), tt.method, rec))
+		})
+	}
+}
+
+func reportProblems(t *testing.T, problems []string) {
+	t.Helper()
+
+	sort.Strings(problems)
+	for _, problem := range problems {
+		t.Error(problem)
+	}
+}
+
+// checkResponse compares rec with the documented responses of
+// the operation method path.
+func (doc *spec) checkResponse(path, method string, rec *httptest.ResponseRecorder) []string {
+	op := method + " " + path
+	raw, ok := doc.Paths[path][strings.ToLower(method)]
+	if !ok {
+		return []string{op + " is not documented"}
+	}
+	var operation specOperation
+	if err := json.Unmarshal(raw, &operation); err != nil {
+		return []string{op + ": " + err.Error()}
+	}
+	response, ok := operation.Responses[strconv.Itoa(rec.Code)]
+	if !ok {
+		return []string{fmt.Sprintf("%s: status %d is not documented", op, rec.Code)}
+	}
+	if name, ok := strings.CutPrefix(response.Ref, "#/components/responses/"); ok {
+		response = doc.Components.Responses[name]
+	}
+
+	if len(response.Content) == 0 {
+		if rec.Body.Len() > 0 {
+			return []string{fmt.Sprintf("%s: status %d has a body but none is documented", op, rec.Code)}
+		}
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	content, ok := response.Content[mediaType]
+	if !ok {
+		return []string{fmt.Sprintf("%s: status %d answers with undocumented type %q", op, rec.Code, mediaType)}
+	}
+	if mediaType != "application/json" {
+		return nil
+	}
+	var body any
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		return []string{fmt.Sprintf("%s: status %d: %v", op, rec.Code, err)}
+	}
+	return doc.checkValue(fmt.Sprintf("%s %d body", op, rec.Code), content.Schema, body)
+}
+
+// checkValue reports where v does not have the shape of schema.
+// Objects must hold their required properties and nothing that is
+// not documented; objects without listed properties hold anything.
+func (doc *spec) checkValue(where string, schema specSchema, v any) []string {
+	if name, ok := strings.CutPrefix(schema.Ref, "#/components/schemas/"); ok {
+		schema = doc.Components.Schemas[name]
+	}
+
+	var problems []string
+	wrongType := func() []string {
+		return []string{fmt.Sprintf("%s: want %s, got %T", where, schema.Type, v)}
+	}
+	switch schema.Type {
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return wrongType()
+		}
+		for _, name := range schema.Required {
+			if _, ok := obj[name]; !ok {
+				problems = append(problems, fmt.Sprintf("%s: required property %q is missing", where, name))
+			}
+		}
+		if schema.Properties == nil {
+			break
+		}
+		for name, value := range obj {
+			property, ok := schema.Properties[name]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%s: property %q is not documented", where, name))
+				continue
+			}
+			problems = append(problems, doc.checkValue(where+"."+name, property, value)...)
+		}
+	case "array":
+		items, ok := v.([]any)
+		if !ok {
+			return wrongType()
+		}
+		if schema.Items == nil {
+			break
+		}
+		for i, item := range items {
+			problems = append(problems, doc.checkValue(fmt.Sprintf("%s[%d]", where, i), *schema.Items, item)...)
+		}
+	case "string":
+		if _, ok := v.(string); !ok {
+			return wrongType()
+		}
+	case "integer":
+		if n, ok := v.(float64); !ok || n != math.Trunc(n) {
+			return wrongType()
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return wrongType()
+		}
+	}
+	if len(schema.Enum) > 0 {
+		found := false
+		for _, allowed := range schema.Enum {
+			found = found || allowed == v
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("%s: %v is not one of %v", where, v, schema.Enum))
+		}
+	}
+	return problems
+}
+
+// compareSchema checks that schema lists exactly the JSON fields
+// of t, descending into nested objects defined inline.
+func compareSchema(name string, schema specSchema, t reflect.Type) []string {
+	if schema.Items != nil {
+		schema = *schema.Items
+	}
+	for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || schema.Properties == nil {
+		return nil
+	}
+
+	var problems []string
+	fields := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		fieldName := jsonName(field)
+		fields[fieldName] = true
+		property, ok := schema.Properties[fieldName]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("schema %s has no property %q", name, fieldName))
+			continue
+		}
+		problems = append(problems, compareSchema(name+"."+fieldName, property, field.Type)...)
+	}
+	for property := range schema.Properties {
+		if !fields[property] {
+			problems = append(problems, fmt.Sprintf("schema %s documents unknown property %q", name, property))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+const mergePatchType = "application/merge-patch+json"
+
+// patchMovie applies a JSON Merge Patch (RFC 7396) to a movie.
+// Only the fields present in the patch change; a null value
+// clears a field. The movie keeps its position in the collection.
+//
+// The patch is applied to the payload shape of the API version
+// being served, so v1 clients patch "string" and v2 clients "title".
+func patchMovie(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != mergePatchType && mediaType != "application/json" {
+		w.Header().Set("Accept-Patch", mergePatchType)
+		writeError(w, r, http.StatusUnsupportedMediaType, codeUnsupported,
+			"PATCH expects a "+mergePatchType+" body")
+		return
+	}
+
+	patch, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeBodyTooLarge(w, r)
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	if !json.Valid(patch) {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "malformed JSON patch")
+		return
+	}
+
+	params := mux.Vars(r)
+
+	current, err := store.Get(r.Context(), params["id"])
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if _, ok := checkIfMatch(w, r, current); !ok {
+		return
+	}
+
+	original, err := json.Marshal(presentMovie(r, current))
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	patched, err := mergePatch(original, dropDirectorID(patch))
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	// From here on the patched document is treated
+	// exactly like the body of a PUT request.
+	movie, ok := parseMovie(w, r, bytes.NewReader(patched))
+	if !ok {
+		return
+	}
+
+	directorRefs.RLock()
+	defer directorRefs.RUnlock()
+	if !linkDirector(w, r, &movie) {
+		return
+	}
+
+	// The patch was computed against the version we just read,
+	// so the write must fail if somebody changed it meanwhile.
+	movie.Version = current.Version
+	movie, err = store.Update(r.Context(), params["id"], movie)
+	if errors.Is(err, ErrVersionConflict) && r.Header.Get("If-Match") == "" {
+		writeError(w, r, http.StatusConflict, codeConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag(r, movie))
+	writeJSON(w, http.StatusOK, presentMovie(r, movie))
+}
+
+// dropDirectorID makes a patch that changes "director" but not
+// "director_id" also remove director_id. Otherwise the current
+// director_id survives the merge and, as resolveDirector prefers
+// it, the new director would be silently ignored.
+func dropDirectorID(patch []byte) []byte {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(patch, &fields); err != nil {
+		return patch
+	}
+	_, director := fields["director"]
+	_, directorID := fields["director_id"]
+	if !director || directorID {
+		return patch
+	}
+	fields["director_id"] = json.RawMessage("null")
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return patch
+	}
+	return out
+}
+
+// mergePatch applies patch to target following RFC 7396.
+func mergePatch(target, patch []byte) ([]byte, error) {
+	var p any
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, err
+	}
+	var t any
+	if err := json.Unmarshal(target, &t); err != nil {
+		return nil, err
+	}
+	return json.Marshal(mergeValue(t, p))
+}
+
+func mergeValue(target, patch any) any {
+	patchObj, ok := patch.(map[string]any)
+	if !ok {
+		// Anything but an object replaces the target wholesale.
+		return patch
+	}
+
+	targetObj, ok := target.(map[string]any)
+	if !ok {
+		targetObj = map[string]any{}
+	}
+	for key, value := range patchObj {
+		if value == nil {
+			delete(targetObj, key)
+		} else {
+			targetObj[key] = mergeValue(targetObj[key], value)
+		}
+	}
+	return targetObj
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMergePatch(t *testing.T) {
+	tests := []struct{ target, patch, want string }{
+		{`{"a":1,"b":2}`, `{"a":3}`, `{"a":3,"b":2}`},
+		{`{"a":1,"b":2}`, `{"a":null}`, `{"b":2}`},
+		{`{"a":{"x":1,"y":2}}`, `{"a":{"y":null,"z":3}}`, `{"a":{"x":1,"z":3}}`},
+		{`{"a":[1,2]}`, `{"a":[3]}`, `{"a":[3]}`},
+		{`{"a":1}`, `[1]`, `[1]`},
+	}
+	for _, tt := range tests {
+		got, err := mergePatch([]byte(tt.target), []byte(tt.patch))
+		if err != nil || string(got) != tt.want {
+			t.Errorf("mergePatch(%s, %s) = %s, %v, want %s", tt.target, tt.patch, got, err, tt.want)
+		}
+	}
+}
+
+func TestPatchDirector(t *testing.T) {
+	tests := []struct {
+		name      string
+		patch     string
+		wantID    string
+		wantFirst string
+	}{
+		{"by name", `{"director": {"firstname": "Jane", "lastname": "Roe"}}`, "3", "Jane"},
+		{"one name only", `{"director": {"firstname": "Jane"}}`, "3", "Jane"},
+		{"by ID", `{"director_id": "2"}`, "2", "Steve"},
+		{"ID wins over name", `{"director_id": "2", "director": {"firstname": "Jane", "lastname": "Roe"}}`, "2", "Steve"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestRouter(t)
+			rec := do(t, h, "PATCH", "/v2/movies/1", tt.patch, "Content-Type", mergePatchType)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("patch = %d: %s", rec.Code, rec.Body)
+			}
+			movie := decode[Movie](t, rec)
+			if movie.DirectorID != tt.wantID || movie.Director == nil || movie.Director.Firstname != tt.wantFirst {
+				t.Errorf("director = %s %+v, want %s %s", movie.DirectorID, movie.Director, tt.wantID, tt.wantFirst)
+			}
+		})
+	}
+}
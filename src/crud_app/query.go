@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultPageSize applies to v2 list requests without ?limit=.
+	// v1 keeps returning the whole collection unless asked otherwise.
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// movieQuery holds the list parameters of GET /movies:
+//
+//	limit=N          page size
+//	cursor=C         continue after the page that returned C as "next"
+//	title=T          title contains T (case-insensitive)
+//	isbn=I           exact ISBN (hyphens and spaces are ignored)
+//	director=D       director "firstname lastname" contains D
+//	director_id=ID   movies of one director
+//	sort=S           title, -title, created or -created
+//
+// Without sort= the movies come in creation order.
+type movieQuery struct {
+	limit      int
+	after      *pageCursor // the last movie of the previous page
+	title      string
+	isbn       string
+	director   string
+	directorID string
+	sort       string
+}
+
+// pageCursor is what a cursor encodes: the sort key and the ID
+// of the last movie of a page. The next page starts with the
+// first movie sorting after it, whether or not that movie is
+// still there, so deletes and edits between requests do not
+// break the walk.
+type pageCursor struct {
+	Sort      string    `json:"s,omitempty"`
+	ID        string    `json:"id"`
+	Title     string    `json:"t,omitempty"`
+	CreatedAt time.Time `json:"c"`
+}
+
+func newCursor(sort string, last Movie) string {
+	c := pageCursor{Sort: sort, ID: last.ID, CreatedAt: last.CreatedAt}
+	if strings.HasSuffix(sort, "title") {
+		c.Title = last.Title
+	}
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func parseMovieQuery(r *http.Request) (movieQuery, error) {
+	values := r.URL.Query()
+	q := movieQuery{
+		title:      strings.ToLower(values.Get("title")),
+		isbn:       normalizeISBN(values.Get("isbn")),
+		director:   strings.ToLower(values.Get("director")),
+		directorID: values.Get("director_id"),
+		sort:       values.Get("sort"),
+	}
+
+	if apiVersion(r) == 2 {
+		q.limit = defaultPageSize
+	}
+	if s := values.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		q.limit = limit
+	}
+
+	switch q.sort {
+	case "", "title", "-title", "created", "-created":
+	default:
+		return q, fmt.Errorf("sort must be one of title, -title, created, -created")
+	}
+
+	if s := values.Get("cursor"); s != "" {
+		data, err := base64.RawURLEncoding.DecodeString(s)
+		var c pageCursor
+		if err != nil || json.Unmarshal(data, &c) != nil || c.ID == "" {
+			return q, fmt.Errorf("malformed cursor")
+		}
+		if c.Sort != q.sort {
+			return q, fmt.Errorf("cursor belongs to a different sort order")
+		}
+		q.after = &c
+	}
+
+	return q, nil
+}
+
+func (q movieQuery) matches(movie Movie) bool {
+	if q.title != "" && !strings.Contains(strings.ToLower(movie.Title), q.title) {
+		return false
+	}
+	if q.isbn != "" && normalizeISBN(movie.Isbn) != q.isbn {
+		return false
+	}
+	if q.directorID != "" && movie.DirectorID != q.directorID {
+		return false
+	}
+	if q.director != "" {
+		if movie.Director == nil {
+			return false
+		}
+		name := strings.ToLower(movie.Director.Firstname + " " + movie.Director.Lastname)
+		if !strings.Contains(name, q.director) {
+			return false
+		}
+	}
+	return true
+}
+
+// apply filters, sorts and pages movies. It returns the
+// page and the cursor of the next page ("" on the last page).
+func (q movieQuery) apply(movies []Movie) ([]Movie, string) {
+	filtered := movies[:0]
+	for _, movie := range movies {
+		if q.matches(movie) {
+			filtered = append(filtered, movie)
+		}
+	}
+
+	// Ties are broken by ID so the order is total and a
+	// cursor always has a well-defined place in it.
+	less := func(a, b Movie) bool {
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		return a.ID < b.ID
+	}
+	if strings.HasSuffix(q.sort, "title") {
+		less = func(a, b Movie) bool {
+			if a.Title != b.Title {
+				return a.Title < b.Title
+			}
+			return a.ID < b.ID
+		}
+	}
+	if strings.HasPrefix(q.sort, "-") {
+		asc := less
+		less = func(a, b Movie) bool { return asc(b, a) }
+	}
+	sort.SliceStable(filtered, func(i, j int) bool {
+		return less(filtered[i], filtered[j])
+	})
+
+	start := 0
+	if q.after != nil {
+		last := Movie{ID: q.after.ID, Title: q.after.Title, CreatedAt: q.after.CreatedAt}
+		start = sort.Search(len(filtered), func(i int) bool {
+			return less(last, filtered[i])
+		})
+	}
+
+	page := filtered[start:]
+	next := ""
+	if q.limit > 0 && len(page) > q.limit {
+		page = page[:q.limit]
+		next = newCursor(q.sort, page[len(page)-1])
+	}
+	return page, next
+}
+
+// nextLink builds the URL of the next page for the Link header.
+func nextLink(r *http.Request, cursor string) string {
+	u := *r.URL
+	values := u.Query()
+	values.Set("cursor", cursor)
+	u.RawQuery = values.Encode()
+	return fmt.Sprintf(`<%s>; rel="next"`, u.RequestURI())
+}
+
+// normalizeISBN strips the separators an ISBN may be written with.
+func normalizeISBN(isbn string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(isbn))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// walk pages through movies with limit 2, calling between(page)
+// after each page, and returns the IDs in the order they came.
+func walk(t *testing.T, movies []Movie, sort string, between func(page []Movie) []Movie) string {
+	t.Helper()
+
+	var ids []string
+	cursor := ""
+	for pages := 0; pages < 10; pages++ {
+		url := "/v2/movies?limit=2&sort=" + sort + "&cursor=" + cursor
+		q, err := parseMovieQuery(httptest.NewRequest("GET", url, nil))
+		if err != nil {
+			t.Fatalf("page %d: %v", pages, err)
+		}
+		page, next := q.apply(movies)
+		for _, movie := range page {
+			ids = append(ids, movie.ID)
+		}
+		if next == "" {
+			return strings.Join(ids, " ")
+		}
+		movies = between(page)
+		cursor = next
+	}
+	t.Fatal("the walk did not end")
+	return ""
+}
+
+func TestCursorSurvivesDeletes(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	all := []Movie{
+		{ID: "1", Title: "Delta", CreatedAt: start},
+		{ID: "2", Title: "Alpha", CreatedAt: start.Add(time.Hour)},
+		{ID: "3", Title: "Echo", CreatedAt: start.Add(2 * time.Hour)},
+		{ID: "4", Title: "Bravo", CreatedAt: start.Add(3 * time.Hour)},
+		{ID: "5", Title: "Charlie", CreatedAt: start.Add(3 * time.Hour)},
+	}
+
+	tests := []struct {
+		sort string
+		want string
+	}{
+		{"", "1 2 3 4 5"},
+		{"title", "2 4 5 1 3"},
+		{"-created", "5 4 3 2 1"},
+	}
+	for _, tt := range tests {
+		if got := walk(t, all, tt.sort, func([]Movie) []Movie { return all }); got != tt.want {
+			t.Errorf("sort=%q: walked %s, want %s", tt.sort, got, tt.want)
+		}
+
+		// Deleting the last movie of each page must not break
+		// the walk: it goes on with the movie after it.
+		movies := all
+		got := walk(t, all, tt.sort, func(page []Movie) []Movie {
+			last := page[len(page)-1].ID
+			var kept []Movie
+			for _, movie := range movies {
+				if movie.ID != last {
+					kept = append(kept, movie)
+				}
+			}
+			movies = kept
+			return movies
+		})
+		if got != tt.want {
+			t.Errorf("sort=%q with deletes: walked %s, want %s", tt.sort, got, tt.want)
+		}
+	}
+}
+
+func TestCursorErrors(t *testing.T) {
+	q, _ := parseMovieQuery(httptest.NewRequest("GET", "/v2/movies?limit=1&sort=title", nil))
+	_, next := q.apply([]Movie{{ID: "1", Title: "A"}, {ID: "2", Title: "B"}})
+
+	for _, url := range []string{
+		"/v2/movies?cursor=!!!",
+		"/v2/movies?cursor=MQ", // the bare ID cursors of old
+		"/v2/movies?sort=-title&cursor=" + next,
+	} {
+		if _, err := parseMovieQuery(httptest.NewRequest("GET", url, nil)); err == nil {
+			t.Errorf("%s: no error", url)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Every client gets a token bucket per kind of route: reads,
+// writes and bulk imports are limited separately (-rate-read,
+// -rate-write, -rate-import). A client is the subject of a valid
+// bearer token, or else the remote IP address. Responses carry
+// the RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset
+// headers; requests over the limit get 429 with Retry-After.
+
+// rate is a limit like "60/m": N requests per period, which may
+// also be used up in one burst. Zero means unlimited.
+type rate struct {
+	N   int
+	Per time.Duration
+}
+
+func (r rate) String() string {
+	if r.N == 0 {
+		return "0"
+	}
+	switch r.Per {
+	case time.Second:
+		return fmt.Sprintf("%d/s", r.N)
+	case time.Minute:
+		return fmt.Sprintf("%d/m", r.N)
+	case time.Hour:
+		return fmt.Sprintf("%d/h", r.N)
+	}
+	return fmt.Sprintf("%d/%s", r.N, r.Per)
+}
+
+// Set parses "N/s", "N/m", "N/h", "N/<duration>" or "0".
+func (r *rate) Set(s string) error {
+	if s == "0" {
+		*r = rate{}
+		return nil
+	}
+	count, period, ok := strings.Cut(s, "/")
+	n, err := strconv.Atoi(count)
+	if !ok || err != nil || n < 1 {
+		return fmt.Errorf("rate %q: want N/period, e.g. 60/m", s)
+	}
+	var per time.Duration
+	switch period {
+	case "s":
+		per = time.Second
+	case "m":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	default:
+		per, err = time.ParseDuration(period)
+		if err != nil || per <= 0 {
+			return fmt.Errorf("rate %q: bad period %q", s, period)
+		}
+	}
+	if per > time.Hour {
+		// limiter.sweep relies on this.
+		return fmt.Errorf("rate %q: the period may be an hour at most", s)
+	}
+	if per/time.Duration(n) == 0 {
+		// limiter.take refills one token every Per/N.
+		return fmt.Errorf("rate %q: more than one request per nanosecond", s)
+	}
+	*r = rate{N: n, Per: per}
+	return nil
+}
+
+// Route kinds with a limit of their own.
+const (
+	limitRead   = "read"
+	limitWrite  = "write"
+	limitImport = "import"
+)
+
+// rateLimits are the limits per route kind (-rate-* flags).
+var rateLimits = map[string]*rate{
+	limitRead:   {N: 600, Per: time.Minute},
+	limitWrite:  {N: 60, Per: time.Minute},
+	limitImport: {N: 5, Per: time.Minute},
+}
+
+// routeKind decides which limit applies to the request.
+func routeKind(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil && route.GetName() == "importMovies" {
+		return limitImport
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return limitRead
+	}
+	return limitWrite
+}
+
+// bucket holds the tokens left at the time of the last request.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter keeps one bucket per client and route kind.
+type limiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+var limits = &limiter{buckets: map[string]*bucket{}}
+
+// take tries to take a token for key out of a bucket filling
+// at rate. It reports whether that worked, how many tokens are
+// left, and how long until the bucket is full again (or, when
+// it is empty, until the next token arrives).
+func (l *limiter) take(key string, limit rate, now time.Time) (ok bool, remaining int, wait time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	perToken := limit.Per / time.Duration(limit.N)
+	capacity := float64(limit.N)
+
+	b, found := l.buckets[key]
+	if !found {
+		b = &bucket{tokens: capacity, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+float64(now.Sub(b.last))/float64(perToken))
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, 0, time.Duration((1 - b.tokens) * float64(perToken))
+	}
+	b.tokens--
+	l.sweep(now)
+	return true, int(b.tokens), time.Duration((capacity - b.tokens) * float64(perToken))
+}
+
+// sweep drops the buckets of clients that have been quiet for
+// a while, so the map does not grow with every address ever
+// seen. A dropped bucket would be full again by now anyway,
+// as no limit has a period longer than an hour.
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > time.Hour {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// clientKey identifies the client behind a request. Tokens are
+// only trusted once verified, so made-up tokens cannot be used
+// to get a fresh bucket. X-Forwarded-For is deliberately ignored:
+// run behind a proxy, every client shares the proxy's limit.
+func clientKey(r *http.Request) string {
+	if token, found := bearerToken(r); found && len(jwtSecret) > 0 {
+		if p, err := verifyToken(token, time.Now()); err == nil {
+			return "sub:" + p.Subject
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// rateLimit enforces rateLimits.
+func rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		kind := routeKind(r)
+		limit := *rateLimits[kind]
+		if limit.N == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ok, remaining, wait := limits.take(kind+" "+clientKey(r), limit, time.Now())
+		seconds := strconv.Itoa(int(math.Ceil(wait.Seconds())))
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.N))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("RateLimit-Reset", seconds)
+		w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.N, int(limit.Per.Seconds())))
+		if !ok {
+			w.Header().Set("Retry-After", seconds)
+			writeError(w, r, http.StatusTooManyRequests, codeRateLimited,
+				fmt.Sprintf("rate limit of %s exceeded, retry in %ss", limit, seconds))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
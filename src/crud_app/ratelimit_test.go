@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRateSet(t *testing.T) {
+	tests := []struct {
+		in   string
+		want rate
+	}{
+		{"0", rate{}},
+		{"60/m", rate{N: 60, Per: time.Minute}},
+		{"5/s", rate{N: 5, Per: time.Second}},
+		{"100/h", rate{N: 100, Per: time.Hour}},
+		{"10/30s", rate{N: 10, Per: 30 * time.Second}},
+		{"1000/1ms", rate{N: 1000, Per: time.Millisecond}},
+	}
+	for _, tt := range tests {
+		var got rate
+		if err := got.Set(tt.in); err != nil || got != tt.want {
+			t.Errorf("Set(%q) = %+v, %v, want %+v", tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "60", "x/m", "0/m", "-1/m", "60/d", "60/-1s", "60/0s", "1/2h", "5/1ns", "1001/1µs"} {
+		var r rate
+		if err := r.Set(in); err == nil {
+			t.Errorf("Set(%q) = %+v, want an error", in, r)
+		}
+	}
+}
+
+func TestTake(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	limit := rate{N: 4, Per: time.Second} // a token every 250ms
+
+	// The steps run in order against the same buckets.
+	tests := []struct {
+		name      string
+		key       string
+		at        time.Duration
+		ok        bool
+		remaining int
+		wait      time.Duration // RateLimit-Reset, or Retry-After when !ok
+	}{
+		{"first", "a", 0, true, 3, 250 * time.Millisecond},
+		{"burst", "a", 0, true, 2, 500 * time.Millisecond},
+		{"burst", "a", 0, true, 1, 750 * time.Millisecond},
+		{"last of the burst", "a", 0, true, 0, time.Second},
+		{"empty", "a", 0, false, 0, 250 * time.Millisecond},
+		{"other key", "b", 0, true, 3, 250 * time.Millisecond},
+		{"partly refilled", "a", 100 * time.Millisecond, false, 0, 150 * time.Millisecond},
+		{"one token back", "a", 250 * time.Millisecond, true, 0, time.Second},
+		{"two tokens back", "a", 750 * time.Millisecond, true, 1, 750 * time.Millisecond},
+		{"refill stops at the burst", "a", time.Hour, true, 3, 250 * time.Millisecond},
+	}
+	l := &limiter{buckets: map[string]*bucket{}}
+	for _, tt := range tests {
+		ok, remaining, wait := l.take(tt.key, limit, start.Add(tt.at))
+		if diff := wait - tt.wait; ok != tt.ok || remaining != tt.remaining || diff < -time.Microsecond || diff > time.Microsecond {
+			t.Errorf("%s at %v: take = %v, %d, %v, want %v, %d, %v",
+				tt.name, tt.at, ok, remaining, wait, tt.ok, tt.remaining, tt.wait)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	h := newTestRouter(t)
+	savedLimits := limits
+	limits = &limiter{buckets: map[string]*bucket{}}
+	t.Cleanup(func() { limits = savedLimits })
+	*rateLimits[limitWrite] = rate{N: 2, Per: time.Minute}
+
+	for i, want := range []string{"1", "0"} {
+		rec := do(t, h, "PATCH", "/v2/movies/1", `{"title": "Limited"}`, "Content-Type", mergePatchType)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("write %d = %d: %s", i+1, rec.Code, rec.Body)
+		}
+		if got := rec.Header().Get("RateLimit-Remaining"); got != want {
+			t.Errorf("write %d: RateLimit-Remaining = %s, want %s", i+1, got, want)
+		}
+	}
+
+	rec := do(t, h, "PATCH", "/v2/movies/1", `{"title": "Limited"}`, "Content-Type", mergePatchType)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("write over the limit = %d, want 429: %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "30" {
+		t.Errorf("Retry-After = %q, want 30", got)
+	}
+	if body := decode[errorEnvelope](t, rec); body.Error.Code != codeRateLimited {
+		t.Errorf("error = %+v, want %s", body.Error, codeRateLimited)
+	}
+
+	// Reads have a limit of their own (none in tests).
+	if rec := do(t, h, "GET", "/v2/movies/1", ""); rec.Code != http.StatusOK {
+		t.Errorf("read after the writes ran out = %d, want 200", rec.Code)
+	}
+}
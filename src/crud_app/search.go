@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// GET /movies/search?q=... finds movies by words of their title
+// or their director's name. Every word of the query must be
+// the start of a word of the movie, ignoring case: "the god"
+// finds "The Godfather", "father" does not. Results are ranked
+// by how often the query words occur in the movie.
+
+// searchIdx is kept up to date through movieEvents.
+var searchIdx = newSearchIndex()
+
+// defaultSearchLimit caps the results when ?limit= is not given.
+const defaultSearchLimit = 20
+
+// searchIndex is an inverted index from words to the movies
+// containing them.
+type searchIndex struct {
+	mu       sync.RWMutex
+	postings map[string]map[string]int // word -> movie ID -> occurrences
+	docs     map[string][]string       // movie ID -> its words, to unindex it
+	terms    []string                  // keys of postings, sorted for prefix lookups
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		postings: map[string]map[string]int{},
+		docs:     map[string][]string{},
+	}
+}
+
+// tokenize splits s into lower-cased words of letters and digits.
+func tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// movieText is what a movie is found by.
+func movieText(ctx context.Context, movie Movie) string {
+	director := movie.Director
+	if director == nil && movie.DirectorID != "" {
+		if d, err := directors.Get(ctx, movie.DirectorID); err == nil {
+			director = &d
+		}
+	}
+	if director == nil {
+		return movie.Title
+	}
+	return movie.Title + " " + director.Firstname + " " + director.Lastname
+}
+
+// onMovieEvent is the movieListener keeping the index in sync.
+func (idx *searchIndex) onMovieEvent(ctx context.Context, event movieEvent) {
+	if event.Op == opDelete || event.Movie.DeletedAt != nil {
+		idx.remove(event.Movie.ID)
+		return
+	}
+	idx.add(event.Movie.ID, movieText(ctx, event.Movie))
+}
+
+// add (re)indexes the movie id under the words of text.
+func (idx *searchIndex) add(id, text string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.removeLocked(id)
+	words := tokenize(text)
+	for _, word := range words {
+		docs, ok := idx.postings[word]
+		if !ok {
+			docs = map[string]int{}
+			idx.postings[word] = docs
+			i := sort.SearchStrings(idx.terms, word)
+			idx.terms = append(idx.terms, "")
+			copy(idx.terms[i+1:], idx.terms[i:])
+			idx.terms[i] = word
+		}
+		docs[id]++
+	}
+	idx.docs[id] = words
+}
+
+func (idx *searchIndex) remove(id string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.removeLocked(id)
+}
+
+func (idx *searchIndex) removeLocked(id string) {
+	for _, word := range idx.docs[id] {
+		docs := idx.postings[word]
+		delete(docs, id)
+		if len(docs) == 0 {
+			delete(idx.postings, word)
+			i := sort.SearchStrings(idx.terms, word)
+			if i < len(idx.terms) && idx.terms[i] == word {
+				idx.terms = append(idx.terms[:i], idx.terms[i+1:]...)
+			}
+		}
+	}
+	delete(idx.docs, id)
+}
+
+// rebuild indexes every stored movie from scratch.
+func (idx *searchIndex) rebuild(ctx context.Context) error {
+	movies, err := store.List(ctx)
+	if err == nil {
+		err = expandDirectors(ctx, movies)
+	}
+	if err != nil {
+		return err
+	}
+
+	idx.mu.Lock()
+	idx.postings = map[string]map[string]int{}
+	idx.docs = map[string][]string{}
+	idx.terms = nil
+	idx.mu.Unlock()
+
+	for _, movie := range movies {
+		idx.add(movie.ID, movieText(ctx, movie))
+	}
+	return nil
+}
+
+// reindexDirector refreshes the movies of a renamed director.
+func (idx *searchIndex) reindexDirector(ctx context.Context, director Director) error {
+	movies, err := moviesByDirector(ctx, director.ID)
+	if err != nil {
+		return err
+	}
+	for _, movie := range movies {
+		movie.Director = &director
+		idx.add(movie.ID, movieText(ctx, movie))
+	}
+	return nil
+}
+
+// search returns the IDs of the movies matching every word of
+// query, best match first, at most limit of them.
+func (idx *searchIndex) search(query string, limit int) []string {
+	words := tokenize(query)
+	if len(words) == 0 {
+		return nil
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	scores := map[string]int{}
+	for n, word := range words {
+		// A query word matches every indexed word it is a prefix of;
+		// those sit next to each other in the sorted terms.
+		matched := map[string]int{}
+		for i := sort.SearchStrings(idx.terms, word); i < len(idx.terms) && strings.HasPrefix(idx.terms[i], word); i++ {
+			for id, count := range idx.postings[idx.terms[i]] {
+				matched[id] += count
+			}
+		}
+		if n == 0 {
+			scores = matched
+			continue
+		}
+		for id := range scores {
+			if count, ok := matched[id]; ok {
+				scores[id] += count
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+
+	ids := make([]string, 0, len(scores))
+	for id := range scores {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if scores[ids[i]] != scores[ids[j]] {
+			return scores[ids[i]] > scores[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	return ids
+}
+
+func searchMovies(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	query := strings.TrimSpace(values.Get("q"))
+	if len(tokenize(query)) == 0 {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "q must contain at least one word")
+		return
+	}
+	limit := defaultSearchLimit
+	if s := values.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxPageSize {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest,
+				fmt.Sprintf("limit must be between 1 and %d", maxPageSize))
+			return
+		}
+		limit = n
+	}
+
+	movies := []Movie{}
+	for _, id := range searchIdx.search(query, limit) {
+		movie, err := store.Get(r.Context(), id)
+		if errors.Is(err, ErrMovieNotFound) {
+			// Deleted since we searched.
+			continue
+		}
+		if err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+		movies = append(movies, movie)
+	}
+	if err := expandDirectors(r.Context(), movies); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, presentMovies(r, movies, ""))
+}
+
+// startSearch hooks the index up to movieEvents and fills it
+// with the movies that are already stored.
+func startSearch(ctx context.Context) error {
+	movieEvents.subscribe(searchIdx.onMovieEvent)
+	return searchIdx.rebuild(ctx)
+}
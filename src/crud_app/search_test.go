@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSearchIndex(t *testing.T) {
+	idx := newSearchIndex()
+	idx.add("1", "The Godfather Francis Coppola")
+	idx.add("2", "The Godfather Part II Francis Coppola")
+	idx.add("3", "Godzilla vs. Godzilla Ishiro Honda")
+	idx.add("4", "Apocalypse Now Francis Coppola")
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"godfather", "1 2"},
+		{"GOD", "3 1 2"},             // prefixes; Godzilla occurs twice
+		{"god francis", "1 2"},       // every word must match
+		{"the god part", "2"},        // ... even with three of them
+		{"father", ""},               // not the start of a word
+		{"coppola-francis", "1 2 4"}, // punctuation separates words
+		{"god honda now", ""},
+		{"ii", "2"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(idx.search(tt.query, 10), " "); got != tt.want {
+			t.Errorf("search(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+	if got := idx.search("francis", 2); len(got) != 2 {
+		t.Errorf("search with limit 2 = %v", got)
+	}
+	if got := idx.search(" -- ", 10); got != nil {
+		t.Errorf("search without words = %v, want nil", got)
+	}
+
+	// Adding a movie again replaces its words.
+	idx.add("3", "Mothra Ishiro Honda")
+	if got := strings.Join(idx.search("god", 10), " "); got != "1 2" {
+		t.Errorf("after reindexing 3: search(god) = %q, want 1 2", got)
+	}
+	if got := strings.Join(idx.search("moth", 10), " "); got != "3" {
+		t.Errorf("after reindexing 3: search(moth) = %q, want 3", got)
+	}
+
+	for _, id := range []string{"1", "2", "3", "4"} {
+		idx.remove(id)
+	}
+	if len(idx.postings) != 0 || len(idx.docs) != 0 || len(idx.terms) != 0 {
+		t.Errorf("index not empty after removing everything: %d postings, %d docs, %d terms",
+			len(idx.postings), len(idx.docs), len(idx.terms))
+	}
+}
+
+// TestSearchFollowsChanges checks that writes through the API
+// reach the index: updates, trash and undelete, director renames.
+func TestSearchFollowsChanges(t *testing.T) {
+	h := newTestRouter(t)
+
+	search := func(q string) string {
+		t.Helper()
+		rec := do(t, h, "GET", "/v2/movies/search?q="+q, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("search %s = %d: %s", q, rec.Code, rec.Body)
+		}
+		var ids []string
+		for _, movie := range decode[movieList](t, rec).Data {
+			ids = append(ids, movie.ID)
+		}
+		return strings.Join(ids, " ")
+	}
+	check := func(step, q, want string) {
+		t.Helper()
+		if got := search(q); got != want {
+			t.Errorf("%s: search %s = %q, want %q", step, q, got, want)
+		}
+	}
+
+	check("seed", "john", "1")
+	check("seed", "movie", "1 2")
+
+	if rec := do(t, h, "PATCH", "/v2/movies/1", `{"title": "Retitled"}`, "Content-Type", mergePatchType); rec.Code != http.StatusOK {
+		t.Fatalf("patch = %d: %s", rec.Code, rec.Body)
+	}
+	check("update", "movie", "2")
+	check("update", "retitled", "1")
+
+	if rec := do(t, h, "DELETE", "/v2/movies/2", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete = %d: %s", rec.Code, rec.Body)
+	}
+	check("trash", "movie", "")
+	if rec := do(t, h, "POST", "/v2/movies/2:undelete", ""); rec.Code != http.StatusOK {
+		t.Fatalf("undelete = %d: %s", rec.Code, rec.Body)
+	}
+	check("undelete", "movie", "2")
+
+	if rec := do(t, h, "PUT", "/v2/directors/1", `{"firstname": "Jane", "lastname": "Roe"}`); rec.Code != http.StatusOK {
+		t.Fatalf("rename director = %d: %s", rec.Code, rec.Body)
+	}
+	check("rename", "john", "")
+	check("rename", "jane+roe", "1")
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrMovieNotFound is returned by a MovieStore when
+// no movie with the requested ID exists.
+var ErrMovieNotFound = errors.New("movie not found")
+
+// ErrVersionConflict is returned by Update and Delete when the
+// caller's expected version no longer matches the stored movie,
+// i.e. somebody else modified it in the meantime.
+var ErrVersionConflict = errors.New("movie was modified by another request")
+
+// ErrMovieExists is returned by Create when the
+// movie ID is already taken by another movie.
+var ErrMovieExists = errors.New("movie already exists")
+
+// ErrStoreFull is returned by Create once the store
+// holds as many movies as it may (-max-movies flag).
+var ErrStoreFull = errors.New("movie store is full")
+
+// MovieStore is the persistence layer behind the movie handlers.
+// Every handler talks to the store only through this interface,
+// so the backing implementation can be swapped at startup.
+//
+// Every write bumps Movie.Version. Update and Delete accept the
+// version the caller last saw (movie.Version and version) and
+// fail with ErrVersionConflict if it is stale; 0 skips the check.
+type MovieStore interface {
+	List(ctx context.Context) ([]Movie, error)
+	Get(ctx context.Context, id string) (Movie, error)
+	Create(ctx context.Context, movie Movie) (Movie, error)
+	Update(ctx context.Context, id string, movie Movie) (Movie, error)
+	Delete(ctx context.Context, id string, version int64) error
+}
+
+// memoryStore keeps the movies in a plain slice,
+// exactly like the original package-level `movies` variable.
+// Everything is lost when the process exits.
+//
+// net/http runs every request in its own goroutine,
+// so the slice is guarded by a RWMutex: any number of
+// readers may hold the lock at once, writers are exclusive.
+//
+// maxMovies caps the number of movies, counting the ones
+// in the trash; 0 means no limit.
+type memoryStore struct {
+	mu        sync.RWMutex
+	movies    []Movie
+	maxMovies int
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{}
+}
+
+func (s *memoryStore) List(ctx context.Context) ([]Movie, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Hand out a copy so callers cannot modify
+	// the backing array behind our back.
+	movies := make([]Movie, len(s.movies))
+	copy(movies, s.movies)
+	return movies, nil
+}
+
+func (s *memoryStore) Get(ctx context.Context, id string) (Movie, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if index := s.indexOf(id); index >= 0 {
+		return s.movies[index], nil
+	}
+	return Movie{}, ErrMovieNotFound
+}
+
+func (s *memoryStore) Create(ctx context.Context, movie Movie) (Movie, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	movie, err := s.prepareCreate(movie, time.Now())
+	if err != nil {
+		return Movie{}, err
+	}
+	s.insert(movie)
+	return movie, nil
+}
+
+func (s *memoryStore) Update(ctx context.Context, id string, movie Movie) (Movie, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	movie, err := s.prepareUpdate(id, movie, time.Now())
+	if err != nil {
+		return Movie{}, err
+	}
+	s.replace(movie)
+	return movie, nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, id string, version int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.prepareDelete(id, version); err != nil {
+		return err
+	}
+	s.remove(id)
+	return nil
+}
+
+// The helpers below split every write into two steps:
+// prepare* checks the write and fills in the bookkeeping
+// fields, while insert/replace/remove apply the final
+// record as-is. fileStore journals the prepared record
+// in between, so replaying the journal reproduces the
+// exact same state. Callers must hold s.mu.
+
+func (s *memoryStore) indexOf(id string) int {
+	for index, item := range s.movies {
+		if item.ID == id {
+			return index
+		}
+	}
+	return -1
+}
+
+func (s *memoryStore) prepareCreate(movie Movie, now time.Time) (Movie, error) {
+	if s.indexOf(movie.ID) >= 0 {
+		return Movie{}, ErrMovieExists
+	}
+	if s.maxMovies > 0 && len(s.movies) >= s.maxMovies {
+		return Movie{}, ErrStoreFull
+	}
+	if movie.CreatedAt.IsZero() {
+		movie.CreatedAt = now
+	}
+	if movie.UpdatedAt.IsZero() {
+		movie.UpdatedAt = movie.CreatedAt
+	}
+	if movie.Version == 0 {
+		movie.Version = 1
+	}
+	return movie, nil
+}
+
+func (s *memoryStore) prepareUpdate(id string, movie Movie, now time.Time) (Movie, error) {
+	index := s.indexOf(id)
+	if index < 0 {
+		return Movie{}, ErrMovieNotFound
+	}
+	existing := s.movies[index]
+	if movie.Version != 0 && movie.Version != existing.Version {
+		return Movie{}, ErrVersionConflict
+	}
+	// Set the ID for the updated movie
+	movie.ID = id
+	// The creation time never changes
+	movie.CreatedAt = existing.CreatedAt
+	movie.UpdatedAt = now
+	movie.Version = existing.Version + 1
+	return movie, nil
+}
+
+func (s *memoryStore) prepareDelete(id string, version int64) error {
+	index := s.indexOf(id)
+	if index < 0 {
+		return ErrMovieNotFound
+	}
+	if version != 0 && version != s.movies[index].Version {
+		return ErrVersionConflict
+	}
+	return nil
+}
+
+func (s *memoryStore) insert(movie Movie) {
+	s.movies = append(s.movies, movie)
+}
+
+func (s *memoryStore) replace(movie Movie) {
+	// Overwrite the movie where it is, so updates
+	// do not change the order of the collection.
+	if index := s.indexOf(movie.ID); index >= 0 {
+		s.movies[index] = movie
+	}
+}
+
+func (s *memoryStore) remove(id string) {
+	if index := s.indexOf(id); index >= 0 {
+		// We can use append() and basic slice operation
+		// to get rid of the movie to be deleted.
+		s.movies = append(s.movies[:index], s.movies[index+1:]...)
+	}
+}
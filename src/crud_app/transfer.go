@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"crud_app/bytesize"
+)
+
+// Bulk transfer of movies:
+//
+//	GET  /movies:export?format=json|ndjson|csv
+//	POST /movies:import?format=json|ndjson|csv[&dry_run=true]
+//
+// The format may also be given through the Accept (export) or
+// Content-Type (import) header. JSON and NDJSON rows use the
+// movie shape of the API version being served; CSV always uses
+// csvHeader, with the director flattened into its own columns.
+
+const (
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+	formatCSV    = "csv"
+)
+
+var formatTypes = map[string]string{
+	formatJSON:   "application/json",
+	formatNDJSON: "application/x-ndjson",
+	formatCSV:    "text/csv",
+}
+
+var csvHeader = []string{
+	"id", "isbn", "title",
+	"director_id", "director_firstname", "director_lastname",
+	"created_at", "updated_at",
+}
+
+// maxImportSize replaces maxBodySize for imports (-max-import flag).
+var maxImportSize = 64 * bytesize.MiB
+
+// transferFormat picks the format from ?format= or the given header.
+func transferFormat(r *http.Request, header string) (string, error) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		if _, ok := formatTypes[format]; !ok {
+			return "", fmt.Errorf("format must be json, ndjson or csv")
+		}
+		return format, nil
+	}
+	for _, value := range strings.Split(r.Header.Get(header), ",") {
+		mediaType, _, _ := mime.ParseMediaType(strings.TrimSpace(value))
+		for format, t := range formatTypes {
+			if mediaType == t {
+				return format, nil
+			}
+		}
+	}
+	return formatJSON, nil
+}
+
+func exportMovies(w http.ResponseWriter, r *http.Request) {
+	format, err := transferFormat(r, "Accept")
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+
+	movies, err := store.List(r.Context())
+	if err == nil {
+		err = expandDirectors(r.Context(), movies)
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", formatTypes[format])
+	w.Header().Set("Content-Disposition", `attachment; filename="movies.`+format+`"`)
+
+	// Rows are written one by one, so the response streams
+	// instead of being built in memory first.
+	bw := bufio.NewWriter(w)
+	switch format {
+	case formatCSV:
+		err = exportCSV(bw, movies)
+	case formatNDJSON:
+		enc := json.NewEncoder(bw)
+		for _, movie := range movies {
+			if err = enc.Encode(presentMovie(r, movie)); err != nil {
+				break
+			}
+		}
+	default:
+		err = exportJSON(bw, r, movies)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		// Too late for an error response, the client will
+		// notice the truncated body.
+		log.Println("Error: exporting movies:", err)
+	}
+}
+
+func exportJSON(w io.Writer, r *http.Request, movies []Movie) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	for i, movie := range movies {
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		row, err := json.Marshal(presentMovie(r, movie))
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "]\n")
+	return err
+}
+
+func exportCSV(w io.Writer, movies []Movie) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, movie := range movies {
+		var first, last string
+		if movie.Director != nil {
+			first, last = movie.Director.Firstname, movie.Director.Lastname
+		}
+		err := cw.Write([]string{
+			movie.ID, movie.Isbn, movie.Title,
+			movie.DirectorID, first, last,
+			movie.CreatedAt.Format(time.RFC3339Nano), movie.UpdatedAt.Format(time.RFC3339Nano),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// importReport is the response of POST /movies:import.
+type importReport struct {
+	DryRun   bool        `json:"dry_run"`
+	Total    int         `json:"total"`
+	Imported int         `json:"imported"`
+	Failed   int         `json:"failed"`
+	Errors   []rowReport `json:"errors"`
+}
+
+// rowReport lists the problems of one rejected row.
+// Rows are numbered from 1, not counting a CSV header.
+type rowReport struct {
+	Row    int          `json:"row"`
+	ID     string       `json:"id,omitempty"`
+	Errors []fieldError `json:"errors"`
+}
+
+// importRow is a decoded row, or the reason it could not be decoded.
+type importRow struct {
+	movie Movie
+	errs  validationErrors
+}
+
+func importMovies(w http.ResponseWriter, r *http.Request) {
+	format, err := transferFormat(r, "Content-Type")
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+
+	report := importReport{DryRun: dryRun, Errors: []rowReport{}}
+
+	// Rows referencing a director must not race with a director delete.
+	directorRefs.RLock()
+	defer directorRefs.RUnlock()
+
+	row := 0
+	seen := map[string]bool{}
+	err = readRows(r, format, func(in importRow) error {
+		row++
+		report.Total++
+		errs, err := importOne(r.Context(), &in, dryRun)
+		if err != nil {
+			return err
+		}
+		if id := in.movie.ID; errs == nil && id != "" {
+			// Only matters for dry runs; a real import
+			// already failed on the store's duplicate check.
+			if seen[id] {
+				errs = validationErrors{{Field: "id", Message: "ID appears more than once in the import"}}
+			}
+			seen[id] = true
+		}
+		if errs != nil {
+			report.Failed++
+			report.Errors = append(report.Errors, rowReport{Row: row, ID: in.movie.ID, Errors: errs})
+			return nil
+		}
+		report.Imported++
+		return nil
+	})
+
+	var tooLarge *http.MaxBytesError
+	var syntax *json.SyntaxError
+	var parse *csv.ParseError
+	switch {
+	case errors.As(err, &tooLarge):
+		writeError(w, r, http.StatusRequestEntityTooLarge, codeTooLarge, "import exceeds "+maxImportSize.String())
+	case errors.As(err, &syntax), errors.As(err, &parse), errors.Is(err, errBadImport), errors.Is(err, bufio.ErrTooLong),
+		errors.Is(err, io.ErrUnexpectedEOF):
+		writeError(w, r, http.StatusBadRequest, codeBadRequest,
+			fmt.Sprintf("cannot read row %d: %v (%d row(s) before it were processed)", row+1, err, report.Imported))
+	case err != nil:
+		writeStoreError(w, r, err)
+	default:
+		writeJSON(w, http.StatusOK, report)
+	}
+}
+
+// importOne validates a decoded row and, unless dryRun is set,
+// creates the movie. Rows keep their ID if they have one.
+func importOne(ctx context.Context, in *importRow, dryRun bool) (validationErrors, error) {
+	if in.errs != nil {
+		return in.errs, nil
+	}
+	movie := in.movie
+
+	if movie.DirectorID != "" && movie.Director != nil &&
+		movie.Director.Firstname != "" && movie.Director.Lastname != "" {
+		// Exports carry both the ID and the name. The ID only
+		// means something to the instance that wrote the file,
+		// so unless it names the same director here the row
+		// goes by the name instead.
+		stored, err := directors.Get(ctx, movie.DirectorID)
+		if errors.Is(err, ErrDirectorNotFound) ||
+			err == nil && !(strings.EqualFold(stored.Firstname, movie.Director.Firstname) &&
+				strings.EqualFold(stored.Lastname, movie.Director.Lastname)) {
+			movie.DirectorID = ""
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	errs, err := resolveDirector(ctx, &movie, dryRun)
+	if err != nil || errs != nil {
+		return errs, err
+	}
+
+	if movie.ID != "" {
+		// Trashed movies still hold on to their ID.
+		_, err := trash.GetAny(ctx, movie.ID)
+		if err == nil {
+			return validationErrors{{Field: "id", Message: "a movie with this ID already exists"}}, nil
+		}
+		if !errors.Is(err, ErrMovieNotFound) {
+			return nil, err
+		}
+	}
+	if dryRun {
+		return nil, nil
+	}
+
+	_, err = insertMovie(ctx, movie)
+	if errors.Is(err, ErrMovieExists) {
+		return validationErrors{{Field: "id", Message: "a movie with this ID already exists"}}, nil
+	}
+	if errors.Is(err, ErrStoreFull) {
+		// Report the rows that did not fit rather than
+		// losing the report of the ones that did.
+		return validationErrors{{Field: "", Message: err.Error()}}, nil
+	}
+	return nil, err
+}
+
+var errBadImport = errors.New("malformed import")
+
+// readRows decodes the request body row by row and calls fn
+// for each of them. Rows that decode but fail validation are
+// passed on with their errors; a body that cannot be parsed
+// at all stops the import.
+func readRows(r *http.Request, format string, fn func(importRow) error) error {
+	switch format {
+	case formatCSV:
+		return readCSV(r.Body, fn)
+	case formatNDJSON:
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(make([]byte, 64*1024), int(maxBodySize))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			if err := fn(decodeRow(r, []byte(line))); err != nil {
+				return err
+			}
+		}
+		return scanner.Err()
+	default:
+		dec := json.NewDecoder(r.Body)
+		if tok, err := dec.Token(); err != nil {
+			return err
+		} else if tok != json.Delim('[') {
+			return fmt.Errorf("%w: expected a JSON array", errBadImport)
+		}
+		for dec.More() {
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return err
+			}
+			if err := fn(decodeRow(r, raw)); err != nil {
+				return err
+			}
+		}
+		_, err := dec.Token()
+		return err
+	}
+}
+
+// decodeRow decodes a JSON row in the shape of the API version.
+func decodeRow(r *http.Request, raw []byte) importRow {
+	var movie Movie
+	var errs validationErrors
+	if apiVersion(r) == 1 {
+		var payload movieV1
+		if err := json.Unmarshal(raw, &payload); err != nil {
+			return importRow{errs: validationErrors{{Field: "", Message: err.Error()}}}
+		}
+		movie, errs = payload.toMovie(), validate(payload)
+	} else {
+		if err := json.Unmarshal(raw, &movie); err != nil {
+			return importRow{errs: validationErrors{{Field: "", Message: err.Error()}}}
+		}
+		errs = validate(movie)
+	}
+	movie.CreatedAt, movie.UpdatedAt, movie.Version = time.Time{}, time.Time{}, 0
+	return importRow{movie: movie, errs: errs}
+}
+
+func readCSV(body io.Reader, fn func(importRow) error) error {
+	cr := csv.NewReader(body)
+	cr.FieldsPerRecord = -1
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	column := map[string]int{}
+	for i, name := range header {
+		column[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+	for _, required := range []string{"isbn", "title"} {
+		if _, ok := column[required]; !ok {
+			return fmt.Errorf("%w: CSV header has no %q column", errBadImport, required)
+		}
+	}
+
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		get := func(name string) string {
+			if i, ok := column[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		movie := Movie{
+			ID:         get("id"),
+			Isbn:       get("isbn"),
+			Title:      get("title"),
+			DirectorID: get("director_id"),
+		}
+		if first, last := get("director_firstname"), get("director_lastname"); first != "" || last != "" {
+			movie.Director = &Director{Firstname: first, Lastname: last}
+		}
+		if err := fn(importRow{movie: movie, errs: validate(movie)}); err != nil {
+			return err
+		}
+	}
+}
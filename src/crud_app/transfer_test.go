@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// TestImportFromOtherInstance imports an export into an instance
+// whose director IDs differ: the rows must be linked by name.
+func TestImportFromOtherInstance(t *testing.T) {
+	for _, format := range []string{formatJSON, formatNDJSON, formatCSV} {
+		t.Run(format, func(t *testing.T) {
+			// Here Ann gets director ID 3 and Jane 4.
+			h := newTestRouter(t)
+			if rec := do(t, h, "POST", "/v2/directors", `{"firstname": "Ann", "lastname": "Other"}`); rec.Code != http.StatusCreated {
+				t.Fatalf("create director = %d: %s", rec.Code, rec.Body)
+			}
+			rec := do(t, h, "POST", "/v2/movies",
+				`{"isbn": "9780306406157", "title": "Roe's", "director": {"firstname": "Jane", "lastname": "Roe"}}`)
+			if rec.Code != http.StatusCreated {
+				t.Fatalf("create = %d: %s", rec.Code, rec.Body)
+			}
+			exported := do(t, h, "GET", "/v2/movies:export?format="+format, "").Body.String()
+
+			// The other instance knows neither of them.
+			h = newTestRouter(t)
+			do(t, h, "DELETE", "/v2/movies/1", "")
+			rec = do(t, h, "POST", "/v2/movies:import", exported, "Content-Type", formatTypes[format])
+			report := decode[importReport](t, rec)
+			// Movie 2 still exists here; movie 1 is in the trash.
+			if rec.Code != http.StatusOK || report.Imported != 1 || report.Failed != 2 {
+				t.Fatalf("import = %d: %s", rec.Code, rec.Body)
+			}
+			for _, row := range report.Errors {
+				if row.Errors[0].Field != "id" {
+					t.Errorf("row %d rejected for %+v, want only ID clashes", row.Row, row.Errors)
+				}
+			}
+
+			movie := decode[Movie](t, do(t, h, "GET", "/v2/movies/3", ""))
+			if movie.DirectorID != "3" || movie.Director == nil || movie.Director.Lastname != "Roe" {
+				t.Errorf("director = %s %+v, want a new Jane Roe with ID 3", movie.DirectorID, movie.Director)
+			}
+		})
+	}
+}
+
+func TestImportUnknownDirectorID(t *testing.T) {
+	h := newTestRouter(t)
+
+	rows := `[
+		{"isbn": "0306406152", "title": "No name", "director_id": "99"},
+		{"isbn": "0306406152", "title": "Known name", "director_id": "99", "director": {"firstname": "Steve", "lastname": "Smith"}},
+		{"isbn": "0306406152", "title": "Known ID", "director_id": "1", "director": {"firstname": "john", "lastname": "DOE"}},
+		{"isbn": "0306406152", "title": "Other name", "director_id": "2", "director": {"firstname": "Totally", "lastname": "Different"}},
+		{"isbn": "0306406152", "title": "Other known name", "director_id": "1", "director": {"firstname": "Steve", "lastname": "Smith"}}
+	]`
+	rec := do(t, h, "POST", "/v2/movies:import", rows)
+	report := decode[importReport](t, rec)
+	if rec.Code != http.StatusOK || report.Imported != 4 || len(report.Errors) != 1 || report.Errors[0].Row != 1 {
+		t.Fatalf("import = %d: %s", rec.Code, rec.Body)
+	}
+
+	// An ID naming another director here does not win over the name.
+	list := decode[movieList](t, do(t, h, "GET", "/v2/movies?limit=100", ""))
+	want := map[string]string{"Known name": "2", "Known ID": "1", "Other name": "3", "Other known name": "2"}
+	for _, movie := range list.Data {
+		if id, ok := want[movie.Title]; ok && movie.DirectorID != id {
+			t.Errorf("%s: director_id = %s, want %s", movie.Title, movie.DirectorID, id)
+		}
+	}
+}
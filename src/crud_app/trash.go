@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Deleting a movie only moves it to the trash by setting
+// DeletedAt. Trashed movies are hidden from every read unless
+// asked for (GET /movies?include_deleted=true), can be brought
+// back with POST /movies/{id}:undelete, and are purged for good
+// once they have been in the trash for -trash-retention.
+
+// ErrMovieNotDeleted is returned by Undelete for movies
+// that are not in the trash.
+var ErrMovieNotDeleted = errors.New("movie is not deleted")
+
+// trash wraps the store in main(); it is the store handlers use.
+var trash *trashStore
+
+// trashStore is a MovieStore decorator implementing soft deletes
+// on top of the wrapped store, which holds the trashed movies
+// alongside the others. Its writes are serialized, so a trashed
+// movie cannot be brought back by an update racing the delete.
+type trashStore struct {
+	MovieStore
+	mu sync.Mutex
+}
+
+func newTrashStore(s MovieStore) *trashStore {
+	return &trashStore{MovieStore: s}
+}
+
+// List returns the movies that are not trashed.
+func (s *trashStore) List(ctx context.Context) ([]Movie, error) {
+	all, err := s.MovieStore.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	movies := all[:0]
+	for _, movie := range all {
+		if movie.DeletedAt == nil {
+			movies = append(movies, movie)
+		}
+	}
+	return movies, nil
+}
+
+// GetAny returns the movie even if it is trashed.
+func (s *trashStore) GetAny(ctx context.Context, id string) (Movie, error) {
+	return s.MovieStore.Get(ctx, id)
+}
+
+// ListAll returns every movie, trashed ones included.
+func (s *trashStore) ListAll(ctx context.Context) ([]Movie, error) {
+	return s.MovieStore.List(ctx)
+}
+
+func (s *trashStore) Get(ctx context.Context, id string) (Movie, error) {
+	movie, err := s.MovieStore.Get(ctx, id)
+	if err != nil {
+		return Movie{}, err
+	}
+	if movie.DeletedAt != nil {
+		return Movie{}, ErrMovieNotFound
+	}
+	return movie, nil
+}
+
+func (s *trashStore) Create(ctx context.Context, movie Movie) (Movie, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	movie.DeletedAt = nil
+	return s.MovieStore.Create(ctx, movie)
+}
+
+func (s *trashStore) Update(ctx context.Context, id string, movie Movie) (Movie, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.Get(ctx, id); err != nil {
+		return Movie{}, err
+	}
+	movie.DeletedAt = nil
+	return s.MovieStore.Update(ctx, id, movie)
+}
+
+// Delete moves the movie to the trash.
+func (s *trashStore) Delete(ctx context.Context, id string, version int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	movie, err := s.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if version != 0 && version != movie.Version {
+		return ErrVersionConflict
+	}
+	now := time.Now()
+	movie.DeletedAt = &now
+	_, err = s.MovieStore.Update(ctx, id, movie)
+	return err
+}
+
+// Undelete takes the movie out of the trash.
+func (s *trashStore) Undelete(ctx context.Context, id string) (Movie, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	movie, err := s.MovieStore.Get(ctx, id)
+	if err != nil {
+		return Movie{}, err
+	}
+	if movie.DeletedAt == nil {
+		return Movie{}, ErrMovieNotDeleted
+	}
+	movie.DeletedAt = nil
+	return s.MovieStore.Update(ctx, id, movie)
+}
+
+// Purge permanently deletes the trashed movies selected by match
+// and reports how many there were.
+func (s *trashStore) Purge(ctx context.Context, match func(Movie) bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all, err := s.MovieStore.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, movie := range all {
+		if movie.DeletedAt == nil || !match(movie) {
+			continue
+		}
+		err := s.MovieStore.Delete(ctx, movie.ID, movie.Version)
+		if err != nil && !errors.Is(err, ErrMovieNotFound) {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+func undeleteMovie(w http.ResponseWriter, r *http.Request) {
+	movie, err := trash.Undelete(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", etag(r, movie))
+	writeJSON(w, http.StatusOK, presentMovie(r, movie))
+}
+
+// includeDeleted reports whether ?include_deleted= asks for
+// trashed movies too.
+func includeDeleted(r *http.Request) bool {
+	value := strings.ToLower(r.URL.Query().Get("include_deleted"))
+	return value == "true" || value == "1"
+}
+
+// startPurger purges expired movies from the trash every interval
+// until the returned stop function is called. stop waits for a
+// purge in progress, so the stores can be closed after it.
+func startPurger(retention, interval time.Duration) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			cutoff := time.Now().Add(-retention)
+			n, err := trash.Purge(ctx, func(movie Movie) bool {
+				return movie.DeletedAt.Before(cutoff)
+			})
+			if err != nil {
+				log.Println("Error: purging the trash:", err)
+			}
+			if n > 0 {
+				log.Printf("purged %d movie(s) from the trash", n)
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
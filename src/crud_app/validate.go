@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Validation rules are attached to struct fields with the
+// `validate` tag, the same way the structs tutorial attaches
+// `required max:"100"` to Animal.Name. Rules are separated
+// by commas:
+//
+//	required  the field must not be empty (or nil for pointers)
+//	max=N     strings may be at most N characters long
+//	isbn      the string must be a valid ISBN-10 or ISBN-13
+//
+// Nested structs (and pointers to structs) are validated too.
+
+// fieldError describes a single rule violation.
+// Field is the JSON path of the offending field.
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validationErrors collects every violation found in a payload,
+// so the client can fix them all in one round trip.
+type validationErrors []fieldError
+
+func (v validationErrors) Error() string {
+	messages := make([]string, len(v))
+	for i, e := range v {
+		messages[i] = e.Field + ": " + e.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// validate checks v (a struct or pointer to struct) against
+// its `validate` tags and returns nil when everything is fine.
+func validate(v any) validationErrors {
+	var errs validationErrors
+	validateStruct(reflect.Indirect(reflect.ValueOf(v)), "", &errs)
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func validateStruct(value reflect.Value, prefix string, errs *validationErrors) {
+	t := value.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		fv := value.Field(i)
+		path := prefix + jsonName(field)
+
+		// Only the first violated rule is reported: a blank
+		// ISBN is missing, not also malformed.
+		for _, rule := range strings.Split(field.Tag.Get("validate"), ",") {
+			if msg := checkRule(rule, fv); msg != "" {
+				*errs = append(*errs, fieldError{Field: path, Message: msg})
+				break
+			}
+		}
+
+		// Walk into nested structs.
+		if fv.Kind() == reflect.Pointer && !fv.IsNil() {
+			fv = fv.Elem()
+		}
+		if fv.Kind() == reflect.Struct && fv.Type().PkgPath() == t.PkgPath() {
+			validateStruct(fv, path+".", errs)
+		}
+	}
+}
+
+// checkRule returns a message describing why value
+// violates rule, or "" if it does not.
+func checkRule(rule string, value reflect.Value) string {
+	name, arg, _ := strings.Cut(strings.TrimSpace(rule), "=")
+	switch name {
+	case "":
+		return ""
+	case "required":
+		if value.Kind() == reflect.String && strings.TrimSpace(value.String()) == "" || value.IsZero() {
+			return "is required"
+		}
+	case "max":
+		limit, err := strconv.Atoi(arg)
+		if err != nil {
+			panic(fmt.Sprintf("validate: bad max rule %q", rule))
+		}
+		if utf8.RuneCountInString(value.String()) > limit {
+			return fmt.Sprintf("must be at most %d characters", limit)
+		}
+	case "isbn":
+		if value.String() != "" && !validISBN(value.String()) {
+			return "must be a valid ISBN-10 or ISBN-13"
+		}
+	default:
+		panic(fmt.Sprintf("validate: unknown rule %q", rule))
+	}
+	return ""
+}
+
+// jsonName returns the key used for the field in JSON payloads.
+func jsonName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" || name == "-" {
+		return field.Name
+	}
+	return name
+}
+
+// validISBN reports whether s is an ISBN-10 or ISBN-13
+// with a correct check digit. Hyphens and spaces are ignored.
+func validISBN(s string) bool {
+	s = normalizeISBN(s)
+
+	switch len(s) {
+	case 10:
+		// ISBN-10: the digits weighted 10 down to 1
+		// must sum to a multiple of 11. The check
+		// digit may be 'X', which stands for 10.
+		sum := 0
+		for i, c := range s {
+			var d int
+			switch {
+			case c >= '0' && c <= '9':
+				d = int(c - '0')
+			case c == 'X' && i == 9:
+				d = 10
+			default:
+				return false
+			}
+			sum += (10 - i) * d
+		}
+		return sum%11 == 0
+	case 13:
+		// ISBN-13: the digits weighted alternately 1 and 3
+		// must sum to a multiple of 10.
+		sum := 0
+		for i, c := range s {
+			if c < '0' || c > '9' {
+				return false
+			}
+			d := int(c - '0')
+			if i%2 == 1 {
+				d *= 3
+			}
+			sum += d
+		}
+		return sum%10 == 0
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidISBN(t *testing.T) {
+	tests := []struct {
+		isbn string
+		want bool
+	}{
+		{"0306406152", true},
+		{"0-306-40615-2", true},
+		{"080442957X", true},
+		{"080442957x", true},
+		{"0 8044 2957 X", true},
+		{"9780306406157", true},
+		{"978-0-306-40615-7", true},
+		{"978 0 306 40615 7", true},
+		{"0306406153", false},    // bad check digit
+		{"9780306406158", false}, // bad check digit
+		{"X804429570", false},    // X only as the check digit
+		{"978030640615X", false}, // no X in ISBN-13
+		{"030640615", false},
+		{"97803064061570", false},
+		{"03064O6152", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := validISBN(tt.isbn); got != tt.want {
+			t.Errorf("validISBN(%q) = %v, want %v", tt.isbn, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	long := strings.Repeat("é", 201)
+
+	tests := []struct {
+		name string
+		v    any
+		want string // validationErrors.Error(), "" for none
+	}{
+		{"valid", Movie{Isbn: "0306406152", Title: "T"}, ""},
+		{"valid pointer", &Movie{Isbn: "0306406152", Title: "T"}, ""},
+		{"missing", Movie{}, "isbn: is required; title: is required"},
+		{"blank ISBN", Movie{Isbn: "  ", Title: "T"}, "isbn: is required"},
+		{"bad ISBN", Movie{Isbn: "123", Title: "T"}, "isbn: must be a valid ISBN-10 or ISBN-13"},
+		{"title counted in characters", Movie{Isbn: "0306406152", Title: long[:400]}, ""},
+		{"long title", Movie{Isbn: "0306406152", Title: long}, "title: must be at most 200 characters"},
+		{"nested director", Movie{Isbn: "0306406152", Title: "T", Director: &Director{Firstname: "J"}},
+			"director.lastname: is required"},
+		{"v1 director required", movieV1{Isbn: "0306406152", Title: "T"}, "director: is required"},
+		{"v1 nested director", movieV1{Isbn: "0306406152", Title: "T", Director: &Director{Lastname: strings.Repeat("a", 101)}},
+			"director.firstname: is required; director.lastname: must be at most 100 characters"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ""
+			if errs := validate(tt.v); errs != nil {
+				got = errs.Error()
+			}
+			if got != tt.want {
+				t.Errorf("validate = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,664 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Webhooks tell other systems about movie changes. Admins
+// register a URL and the events it wants:
+//
+//	GET    /webhooks                               every subscription
+//	POST   /webhooks                               subscribe
+//	GET    /webhooks/{id}                          one subscription
+//	DELETE /webhooks/{id}                          unsubscribe
+//	GET    /webhooks/{id}/deliveries               pending and dead deliveries
+//	POST   /webhooks/{id}/deliveries/{delivery}:retry  requeue a dead one
+//
+// Every change is POSTed to the subscribed URLs as
+//
+//	{"id": "...", "event": "movie.created", "occurred_at": "...", "data": {movie}}
+//
+// signed with the subscription's secret: Webhook-Signature is
+// "sha256=" and the hex HMAC-SHA256 of
+// "<Webhook-Id>.<Webhook-Timestamp>.<body>". Failed deliveries are
+// retried with exponential backoff; after -webhook-attempts they
+// are dead-lettered and kept until retried by hand. Deliveries
+// may arrive more than once and out of order, receivers should
+// deduplicate by Webhook-Id. With -store=file the subscriptions
+// and the queue are journaled to -webhooks-data.
+
+// The events a webhook can subscribe to, by auditOp.
+var webhookEvents = map[string]string{
+	"create":   "movie.created",
+	"update":   "movie.updated",
+	"trash":    "movie.deleted",
+	"undelete": "movie.undeleted",
+	"delete":   "movie.purged",
+}
+
+// webhooks delivers the events, set up in main().
+var webhooks *webhookDispatcher
+
+var (
+	// webhookAttempts is how often a delivery is tried before
+	// it is dead-lettered (-webhook-attempts flag).
+	webhookAttempts = 8
+
+	// The delay before retry n is webhookBackoff * 2^(n-1),
+	// up to webhookMaxBackoff.
+	webhookBackoff    = 10 * time.Second
+	webhookMaxBackoff = time.Hour
+)
+
+const (
+	// webhookWorkers is how many deliveries are sent at once.
+	webhookWorkers = 4
+
+	// webhookTimeout bounds a single delivery attempt.
+	webhookTimeout = 10 * time.Second
+)
+
+var (
+	// ErrWebhookNotFound is returned for unknown subscriptions.
+	ErrWebhookNotFound = errors.New("webhook not found")
+
+	// ErrDeliveryNotFound is returned for unknown deliveries.
+	ErrDeliveryNotFound = errors.New("delivery not found")
+
+	// ErrDeliveryNotDead is returned when retrying a delivery
+	// that is still being retried automatically.
+	ErrDeliveryNotDead = errors.New("delivery is not dead-lettered")
+)
+
+// webhook is a subscription. The secret is only shown once,
+// in the response to the POST that created it.
+type webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url" validate:"required,max=2048"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty" validate:"max=256"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// webhookList is the v2 envelope of the subscriptions.
+type webhookList struct {
+	Data []webhook `json:"data"`
+}
+
+// delivery is one event on its way to one webhook.
+type delivery struct {
+	ID          string          `json:"id"`
+	WebhookID   string          `json:"webhook_id"`
+	Event       string          `json:"event"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	LastError   string          `json:"last_error,omitempty"`
+	Dead        bool            `json:"dead"`
+}
+
+// deliveryList is the v2 envelope of a webhook's deliveries.
+type deliveryList struct {
+	Data []delivery `json:"data"`
+}
+
+// webhookPayload is the body POSTed to the webhooks.
+type webhookPayload struct {
+	ID         string    `json:"id"`
+	Event      string    `json:"event"`
+	OccurredAt time.Time `json:"occurred_at"`
+	Data       Movie     `json:"data"`
+}
+
+// webhookRecord is a single entry of the webhook journal:
+// subscribe and unsubscribe, the current state of a delivery,
+// or a delivery that is done with.
+type webhookRecord struct {
+	Op       string    `json:"op"`
+	Webhook  *webhook  `json:"webhook,omitempty"`
+	Delivery *delivery `json:"delivery,omitempty"`
+	ID       string    `json:"id,omitempty"`
+}
+
+// webhookDispatcher keeps the subscriptions and the delivery
+// queue, and sends the deliveries in the background.
+type webhookDispatcher struct {
+	mu       sync.Mutex
+	hooks    []webhook
+	queue    map[string]*delivery // by delivery ID
+	inFlight map[string]bool
+	journal  *journal // nil when nothing is persisted
+
+	client *http.Client
+	wake   chan struct{}
+	stop   context.CancelFunc
+	done   sync.WaitGroup
+}
+
+// newWebhookDispatcher replays the journal at path, if one is
+// given. Deliveries only start once start is called.
+func newWebhookDispatcher(path string) (*webhookDispatcher, error) {
+	d := &webhookDispatcher{
+		queue:    map[string]*delivery{},
+		inFlight: map[string]bool{},
+		client:   &http.Client{Timeout: webhookTimeout},
+		wake:     make(chan struct{}, 1),
+	}
+	if path == "" {
+		return d, nil
+	}
+
+	j, err := openJournal(path, d.replay)
+	if err != nil {
+		return nil, err
+	}
+	d.journal = j
+	return d, nil
+}
+
+func (d *webhookDispatcher) replay(line []byte) error {
+	var rec webhookRecord
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return err
+	}
+	switch rec.Op {
+	case "subscribe":
+		if rec.Webhook == nil {
+			return errors.New("subscribe record without webhook")
+		}
+		d.hooks = append(d.hooks, *rec.Webhook)
+	case "unsubscribe":
+		d.removeHook(rec.ID)
+	case "delivery":
+		if rec.Delivery == nil {
+			return errors.New("delivery record without delivery")
+		}
+		d.queue[rec.Delivery.ID] = rec.Delivery
+	case "delivered":
+		delete(d.queue, rec.ID)
+	default:
+		return fmt.Errorf("unknown op %q", rec.Op)
+	}
+	return nil
+}
+
+// record journals rec; d.mu must be held.
+func (d *webhookDispatcher) record(rec webhookRecord) error {
+	if d.journal == nil {
+		return nil
+	}
+	return d.journal.append(rec)
+}
+
+// Close stops the deliveries and closes the journal.
+func (d *webhookDispatcher) Close() error {
+	if d.stop != nil {
+		d.stop()
+		d.done.Wait()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.journal == nil {
+		return nil
+	}
+	return d.journal.Close()
+}
+
+func (d *webhookDispatcher) list() []webhook {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	hooks := make([]webhook, len(d.hooks))
+	copy(hooks, d.hooks)
+	return hooks
+}
+
+func (d *webhookDispatcher) get(id string) (webhook, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if index := d.indexOf(id); index >= 0 {
+		return d.hooks[index], nil
+	}
+	return webhook{}, ErrWebhookNotFound
+}
+
+func (d *webhookDispatcher) subscribe(hook webhook) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.record(webhookRecord{Op: "subscribe", Webhook: &hook}); err != nil {
+		return err
+	}
+	d.hooks = append(d.hooks, hook)
+	return nil
+}
+
+// unsubscribe removes the webhook and drops its deliveries.
+func (d *webhookDispatcher) unsubscribe(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.indexOf(id) < 0 {
+		return ErrWebhookNotFound
+	}
+	if err := d.record(webhookRecord{Op: "unsubscribe", ID: id}); err != nil {
+		return err
+	}
+	d.removeHook(id)
+	return nil
+}
+
+// removeHook drops the webhook and its queue; d.mu must be held.
+// The deliveries need no records of their own, replaying the
+// unsubscribe drops them as well.
+func (d *webhookDispatcher) removeHook(id string) {
+	if index := d.indexOf(id); index >= 0 {
+		d.hooks = append(d.hooks[:index], d.hooks[index+1:]...)
+	}
+	for key, del := range d.queue {
+		if del.WebhookID == id {
+			delete(d.queue, key)
+		}
+	}
+}
+
+func (d *webhookDispatcher) indexOf(id string) int {
+	for i, hook := range d.hooks {
+		if hook.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// deliveries returns the queue of a webhook, oldest first.
+func (d *webhookDispatcher) deliveries(id string) ([]delivery, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.indexOf(id) < 0 {
+		return nil, ErrWebhookNotFound
+	}
+	list := []delivery{}
+	for _, del := range d.queue {
+		if del.WebhookID == id {
+			list = append(list, *del)
+		}
+	}
+	// Delivery IDs are random, the payload knows the time.
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].NextAttempt.Before(list[j].NextAttempt)
+	})
+	return list, nil
+}
+
+// retry puts a dead-lettered delivery back into the queue,
+// with a fresh set of attempts.
+func (d *webhookDispatcher) retry(hookID, id string) (delivery, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.indexOf(hookID) < 0 {
+		return delivery{}, ErrWebhookNotFound
+	}
+	del, ok := d.queue[id]
+	if !ok || del.WebhookID != hookID {
+		return delivery{}, ErrDeliveryNotFound
+	}
+	if !del.Dead {
+		return delivery{}, ErrDeliveryNotDead
+	}
+
+	retried := *del
+	retried.Dead, retried.Attempts, retried.NextAttempt = false, 0, time.Now().UTC()
+	if err := d.record(webhookRecord{Op: "delivery", Delivery: &retried}); err != nil {
+		return delivery{}, err
+	}
+	*del = retried
+	d.poke()
+	return retried, nil
+}
+
+// onMovieEvent is the movieListener queueing a delivery for
+// every webhook subscribed to the event.
+func (d *webhookDispatcher) onMovieEvent(ctx context.Context, event movieEvent) {
+	name := webhookEvents[auditOp(event)]
+	now := time.Now().UTC()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	queued := false
+	for _, hook := range d.hooks {
+		if !contains(hook.Events, name) {
+			continue
+		}
+		id := newRequestID()
+		payload, err := json.Marshal(webhookPayload{ID: id, Event: name, OccurredAt: now, Data: event.Movie})
+		if err != nil {
+			log.Println("Error: encoding webhook payload:", err)
+			return
+		}
+		del := &delivery{ID: id, WebhookID: hook.ID, Event: name, Payload: payload, NextAttempt: now}
+		// The movie itself is already written, so all we
+		// can do about a failing journal is complain.
+		if err := d.record(webhookRecord{Op: "delivery", Delivery: del}); err != nil {
+			log.Printf("Error: queueing %s for webhook %s: %v", name, hook.ID, err)
+		}
+		d.queue[id] = del
+		queued = true
+	}
+	if queued {
+		d.poke()
+	}
+}
+
+// poke wakes the dispatch loop without blocking.
+func (d *webhookDispatcher) poke() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// start sends the queued deliveries until Close is called.
+func (d *webhookDispatcher) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	d.stop = cancel
+	d.done.Add(1)
+	go d.run(ctx)
+}
+
+func (d *webhookDispatcher) run(ctx context.Context) {
+	defer d.done.Done()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		next := d.dispatch(ctx)
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// dispatch starts the deliveries that are due, as far as there
+// are workers free, and returns when the next one will be due
+// (zero if none is waiting).
+func (d *webhookDispatcher) dispatch(ctx context.Context) time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	var next time.Time
+	for id, del := range d.queue {
+		if del.Dead || d.inFlight[id] {
+			continue
+		}
+		if del.NextAttempt.After(now) {
+			if next.IsZero() || del.NextAttempt.Before(next) {
+				next = del.NextAttempt
+			}
+			continue
+		}
+		if len(d.inFlight) >= webhookWorkers {
+			// A finishing attempt wakes the loop again.
+			continue
+		}
+		index := d.indexOf(del.WebhookID)
+		if index < 0 {
+			// Left behind by a journal cut short.
+			delete(d.queue, id)
+			continue
+		}
+		d.inFlight[id] = true
+		d.done.Add(1)
+		go d.attempt(ctx, d.hooks[index], *del)
+	}
+	return next
+}
+
+// attempt sends the delivery once and records the outcome.
+func (d *webhookDispatcher) attempt(ctx context.Context, hook webhook, del delivery) {
+	defer d.done.Done()
+
+	err := d.send(ctx, hook, del)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	defer d.poke()
+
+	delete(d.inFlight, del.ID)
+	current, ok := d.queue[del.ID]
+	if !ok {
+		// Unsubscribed in the meantime.
+		return
+	}
+	if ctx.Err() != nil {
+		// Shutting down; the delivery stays queued for next time.
+		return
+	}
+
+	if err == nil {
+		if err := d.record(webhookRecord{Op: "delivered", ID: del.ID}); err != nil {
+			log.Printf("Error: recording delivery %s: %v", del.ID, err)
+		}
+		delete(d.queue, del.ID)
+		return
+	}
+
+	updated := *current
+	updated.Attempts++
+	updated.LastError = err.Error()
+	if updated.Attempts >= webhookAttempts {
+		updated.Dead = true
+		log.Printf("webhook %s: giving up on delivery %s after %d attempts: %v", hook.ID, del.ID, updated.Attempts, err)
+	} else {
+		updated.NextAttempt = time.Now().UTC().Add(backoff(updated.Attempts))
+	}
+	if err := d.record(webhookRecord{Op: "delivery", Delivery: &updated}); err != nil {
+		log.Printf("Error: recording delivery %s: %v", del.ID, err)
+	}
+	*current = updated
+}
+
+// send POSTs the payload, signed, and fails unless the
+// receiver answers with a 2xx status.
+func (d *webhookDispatcher) send(ctx context.Context, hook webhook, del delivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(del.Payload))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "crud_app-webhooks")
+	req.Header.Set("Webhook-Id", del.ID)
+	req.Header.Set("Webhook-Event", del.Event)
+	req.Header.Set("Webhook-Timestamp", timestamp)
+	req.Header.Set("Webhook-Signature", "sha256="+signWebhook(hook.Secret, del.ID, timestamp, del.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Drain a little, so the connection can be reused.
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return nil
+}
+
+// signWebhook returns the hex HMAC-SHA256 receivers check
+// Webhook-Signature against.
+func signWebhook(secret, id, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(id + "." + timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// backoff is the delay before the retry following attempt n,
+// with up to 10% jitter so failed deliveries spread out.
+func backoff(n int) time.Duration {
+	delay := webhookMaxBackoff
+	if n < 32 && webhookBackoff<<(n-1) < webhookMaxBackoff {
+		delay = webhookBackoff << (n - 1)
+	}
+	return delay + time.Duration(mathrand.Int63n(int64(delay)/10+1))
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// publicWebhook hides the secret.
+func publicWebhook(hook webhook) webhook {
+	hook.Secret = ""
+	return hook
+}
+
+func getWebhooks(w http.ResponseWriter, r *http.Request) {
+	list := webhooks.list()
+	for i := range list {
+		list[i] = publicWebhook(list[i])
+	}
+	if apiVersion(r) == 2 {
+		writeJSON(w, http.StatusOK, webhookList{Data: list})
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func getWebhook(w http.ResponseWriter, r *http.Request) {
+	hook, err := webhooks.get(mux.Vars(r)["id"])
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, publicWebhook(hook))
+}
+
+// createWebhook subscribes a URL. Without a secret in the
+// request one is generated; either way it is sent back once.
+func createWebhook(w http.ResponseWriter, r *http.Request) {
+	var hook webhook
+	if !decodeJSON(w, r, r.Body, &hook) {
+		return
+	}
+
+	errs := validate(hook)
+	if u, err := url.Parse(hook.URL); hook.URL != "" && (err != nil || u.Host == "" || u.Scheme != "http" && u.Scheme != "https") {
+		errs = append(errs, fieldError{Field: "url", Message: "must be an absolute http or https URL"})
+	}
+	if len(hook.Events) == 0 {
+		errs = append(errs, fieldError{Field: "events", Message: "is required"})
+	}
+	known := map[string]bool{}
+	for _, name := range webhookEvents {
+		known[name] = true
+	}
+	for i, name := range hook.Events {
+		if !known[name] {
+			errs = append(errs, fieldError{Field: fmt.Sprintf("events[%d]", i), Message: "unknown event " + strconv.Quote(name)})
+		}
+	}
+	if hook.Secret != "" && len(hook.Secret) < 16 {
+		errs = append(errs, fieldError{Field: "secret", Message: "must be at least 16 characters"})
+	}
+	if len(errs) > 0 {
+		writeValidationError(w, r, errs)
+		return
+	}
+
+	if hook.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+		hook.Secret = hex.EncodeToString(secret)
+	}
+	hook.ID = newRequestID()
+	hook.CreatedAt = time.Now().UTC()
+	if err := webhooks.subscribe(hook); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Location", apiPrefix(r)+"/webhooks/"+hook.ID)
+	writeJSON(w, http.StatusCreated, hook)
+}
+
+func deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	if err := webhooks.unsubscribe(mux.Vars(r)["id"]); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func getWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	list, err := webhooks.deliveries(mux.Vars(r)["id"])
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if apiVersion(r) == 2 {
+		writeJSON(w, http.StatusOK, deliveryList{Data: list})
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func retryWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	del, err := webhooks.retry(vars["id"], vars["delivery"])
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, del)
+}
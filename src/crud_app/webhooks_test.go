@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver is a webhook endpoint recording what it is sent.
+type receiver struct {
+	*httptest.Server
+	got chan receivedHook
+
+	mu     sync.Mutex
+	status int
+}
+
+type receivedHook struct {
+	header http.Header
+	body   []byte
+	at     time.Time
+}
+
+func newReceiver(t *testing.T, status int) *receiver {
+	t.Helper()
+
+	rcv := &receiver{got: make(chan receivedHook, 100), status: status}
+	rcv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rcv.got <- receivedHook{header: r.Header, body: body, at: time.Now()}
+		rcv.mu.Lock()
+		defer rcv.mu.Unlock()
+		w.WriteHeader(rcv.status)
+	}))
+	t.Cleanup(rcv.Close)
+	return rcv
+}
+
+func (rcv *receiver) answer(status int) {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	rcv.status = status
+}
+
+func (rcv *receiver) next(t *testing.T) receivedHook {
+	t.Helper()
+
+	select {
+	case hook := <-rcv.got:
+		return hook
+	case <-time.After(5 * time.Second):
+		t.Fatal("no webhook delivery arrived")
+		return receivedHook{}
+	}
+}
+
+// withWebhookTiming shortens the retries for the rest of the test.
+func withWebhookTiming(t *testing.T, backoff time.Duration, attempts int) {
+	savedBackoff, savedMax, savedAttempts := webhookBackoff, webhookMaxBackoff, webhookAttempts
+	webhookBackoff, webhookMaxBackoff, webhookAttempts = backoff, time.Minute, attempts
+	t.Cleanup(func() {
+		webhookBackoff, webhookMaxBackoff, webhookAttempts = savedBackoff, savedMax, savedAttempts
+	})
+}
+
+// waitFor polls cond until it holds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatal("timed out waiting for " + what)
+}
+
+// subscribe creates a webhook through the API.
+func subscribe(t *testing.T, h http.Handler, url string, events ...string) webhook {
+	t.Helper()
+
+	body, _ := json.Marshal(webhook{URL: url, Events: events, Secret: "0123456789abcdef"})
+	rec := do(t, h, "POST", "/v2/webhooks", string(body))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("subscribe = %d: %s", rec.Code, rec.Body)
+	}
+	return decode[webhook](t, rec)
+}
+
+func deliveriesOf(t *testing.T, h http.Handler, hook webhook) []delivery {
+	t.Helper()
+	return decode[deliveryList](t, do(t, h, "GET", "/v2/webhooks/"+hook.ID+"/deliveries", "")).Data
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	h := newTestRouter(t)
+	rcv := newReceiver(t, http.StatusNoContent)
+	hook := subscribe(t, h, rcv.URL, "movie.created", "movie.deleted")
+
+	if rec := do(t, h, "PATCH", "/v2/movies/1", `{"title": "Not subscribed"}`, "Content-Type", mergePatchType); rec.Code != http.StatusOK {
+		t.Fatalf("patch = %d", rec.Code)
+	}
+	if rec := do(t, h, "POST", "/v2/movies", newMovieV2); rec.Code != http.StatusCreated {
+		t.Fatalf("create = %d", rec.Code)
+	}
+
+	got := rcv.next(t)
+	header := got.header
+	want := "sha256=" + signWebhook(hook.Secret, header.Get("Webhook-Id"), header.Get("Webhook-Timestamp"), got.body)
+	if header.Get("Webhook-Signature") != want {
+		t.Errorf("Webhook-Signature = %s, want %s", header.Get("Webhook-Signature"), want)
+	}
+	if header.Get("Webhook-Event") != "movie.created" {
+		t.Errorf("Webhook-Event = %s, want movie.created", header.Get("Webhook-Event"))
+	}
+
+	var payload webhookPayload
+	if err := json.Unmarshal(got.body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.ID != header.Get("Webhook-Id") || payload.Event != "movie.created" || payload.Data.Title != "New" {
+		t.Errorf("payload = %+v, want the created movie", payload)
+	}
+
+	waitFor(t, "the delivery to be forgotten", func() bool { return len(deliveriesOf(t, h, hook)) == 0 })
+	select {
+	case extra := <-rcv.got:
+		t.Errorf("unexpected delivery of %s", extra.header.Get("Webhook-Event"))
+	default:
+	}
+}
+
+func TestWebhookRetryBackoff(t *testing.T) {
+	withWebhookTiming(t, 50*time.Millisecond, 5)
+	h := newTestRouter(t)
+	rcv := newReceiver(t, http.StatusInternalServerError)
+	hook := subscribe(t, h, rcv.URL, "movie.created")
+
+	if rec := do(t, h, "POST", "/v2/movies", newMovieV2); rec.Code != http.StatusCreated {
+		t.Fatalf("create = %d", rec.Code)
+	}
+
+	first := rcv.next(t)
+	second := rcv.next(t)
+	rcv.answer(http.StatusOK)
+	third := rcv.next(t)
+
+	id := first.header.Get("Webhook-Id")
+	if second.header.Get("Webhook-Id") != id || third.header.Get("Webhook-Id") != id {
+		t.Error("retries changed the Webhook-Id")
+	}
+	// The delay doubles: 50ms before the first retry, 100ms before the second.
+	if gap := second.at.Sub(first.at); gap < 50*time.Millisecond {
+		t.Errorf("first retry after %v, want at least 50ms", gap)
+	}
+	if gap := third.at.Sub(second.at); gap < 100*time.Millisecond {
+		t.Errorf("second retry after %v, want at least 100ms", gap)
+	}
+	waitFor(t, "the delivery to be forgotten", func() bool { return len(deliveriesOf(t, h, hook)) == 0 })
+}
+
+func TestBackoff(t *testing.T) {
+	withWebhookTiming(t, time.Second, 8)
+	webhookMaxBackoff = 5 * time.Second
+
+	for n, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 40: 5 * time.Second} {
+		if got := backoff(n); got < want || got > want+want/10 {
+			t.Errorf("backoff(%d) = %v, want %v plus at most 10%%", n, got, want)
+		}
+	}
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	withWebhookTiming(t, 10*time.Millisecond, 2)
+	h := newTestRouter(t)
+	rcv := newReceiver(t, http.StatusServiceUnavailable)
+	hook := subscribe(t, h, rcv.URL, "movie.created")
+
+	if rec := do(t, h, "POST", "/v2/movies", newMovieV2); rec.Code != http.StatusCreated {
+		t.Fatalf("create = %d", rec.Code)
+	}
+
+	var dead delivery
+	waitFor(t, "the delivery to be dead-lettered", func() bool {
+		list := deliveriesOf(t, h, hook)
+		if len(list) == 1 && list[0].Dead {
+			dead = list[0]
+			return true
+		}
+		return false
+	})
+	if dead.Attempts != 2 || !strings.Contains(dead.LastError, "503") {
+		t.Errorf("dead delivery = %+v, want 2 attempts and the 503", dead)
+	}
+	rcv.next(t)
+	rcv.next(t)
+
+	// Dead deliveries stay put until retried by hand.
+	time.Sleep(50 * time.Millisecond)
+	if len(rcv.got) != 0 {
+		t.Error("a dead delivery was retried on its own")
+	}
+
+	rcv.answer(http.StatusOK)
+	retry := "/v2/webhooks/" + hook.ID + "/deliveries/" + dead.ID + ":retry"
+	rec := do(t, h, "POST", retry, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("retry = %d: %s", rec.Code, rec.Body)
+	}
+	if retried := decode[delivery](t, rec); retried.Dead || retried.Attempts != 0 {
+		t.Errorf("retried delivery = %+v, want a fresh one", retried)
+	}
+	if got := rcv.next(t); got.header.Get("Webhook-Id") != dead.ID {
+		t.Errorf("retry delivered %s, want %s", got.header.Get("Webhook-Id"), dead.ID)
+	}
+	waitFor(t, "the delivery to be forgotten", func() bool { return len(deliveriesOf(t, h, hook)) == 0 })
+
+	if rec := do(t, h, "POST", retry, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("retry of a delivered delivery = %d, want 404", rec.Code)
+	}
+}
+
+func TestWebhookRetryErrors(t *testing.T) {
+	d, err := newWebhookDispatcher("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.subscribe(webhook{ID: "w", URL: "http://127.0.0.1:1/", Events: []string{"movie.created"}})
+	d.onMovieEvent(context.Background(), movieEvent{Op: opCreate, Movie: Movie{ID: "1"}})
+	list, _ := d.deliveries("w")
+	if len(list) != 1 {
+		t.Fatalf("%d deliveries queued, want 1", len(list))
+	}
+
+	if _, err := d.retry("w", list[0].ID); !errors.Is(err, ErrDeliveryNotDead) {
+		t.Errorf("retry of a pending delivery: err = %v, want ErrDeliveryNotDead", err)
+	}
+	if _, err := d.retry("w", "nope"); !errors.Is(err, ErrDeliveryNotFound) {
+		t.Errorf("retry of an unknown delivery: err = %v, want ErrDeliveryNotFound", err)
+	}
+	if _, err := d.retry("nope", list[0].ID); !errors.Is(err, ErrWebhookNotFound) {
+		t.Errorf("retry on an unknown webhook: err = %v, want ErrWebhookNotFound", err)
+	}
+}
+
+func TestWebhookJournalReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhooks.jsonl")
+	rcv := newReceiver(t, http.StatusOK)
+	ctx := context.Background()
+	created := movieEvent{Op: opCreate, Movie: Movie{ID: "1", Title: "One"}}
+
+	// Queue while nothing is sent, as if the process died
+	// before the deliveries went out.
+	d, err := newWebhookDispatcher(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.subscribe(webhook{ID: "kept", URL: rcv.URL, Events: []string{"movie.created"}, Secret: "0123456789abcdef"})
+	d.subscribe(webhook{ID: "dropped", URL: rcv.URL, Events: []string{"movie.created"}})
+	d.onMovieEvent(ctx, created)
+	d.onMovieEvent(ctx, movieEvent{Op: opDelete, Movie: created.Movie})
+	if err := d.unsubscribe("dropped"); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	d, err = newWebhookDispatcher(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hooks := d.list(); len(hooks) != 1 || hooks[0].ID != "kept" || hooks[0].Secret == "" {
+		t.Fatalf("replayed webhooks = %+v, want only kept, with its secret", hooks)
+	}
+	queued, _ := d.deliveries("kept")
+	if len(queued) != 1 || queued[0].Event != "movie.created" {
+		t.Fatalf("replayed deliveries = %+v, want the movie.created one", queued)
+	}
+
+	d.start()
+	if got := rcv.next(t); got.header.Get("Webhook-Id") != queued[0].ID {
+		t.Errorf("delivered %s, want the replayed %s", got.header.Get("Webhook-Id"), queued[0].ID)
+	}
+	waitFor(t, "the delivery to be forgotten", func() bool {
+		list, _ := d.deliveries("kept")
+		return len(list) == 0
+	})
+	d.Close()
+
+	d, err = newWebhookDispatcher(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if list, _ := d.deliveries("kept"); len(list) != 0 {
+		t.Errorf("delivered deliveries came back after a restart: %+v", list)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// A small server side implementation of the WebSocket protocol
+// (RFC 6455), just enough for the live editing channel: text
+// messages, fragmentation, ping/pong and the closing handshake.
+// Extensions and subprotocols are not supported.
+
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// Close codes used by the server.
+const (
+	wsNormalClosure   = 1000
+	wsGoingAway       = 1001
+	wsProtocolError   = 1002
+	wsUnsupportedData = 1003
+	wsNoStatus        = 1005
+	wsInvalidPayload  = 1007
+	wsPolicyViolation = 1008
+	wsMessageTooBig   = 1009
+	wsTryAgainLater   = 1013
+)
+
+const (
+	// wsMaxMessage caps the size of a (reassembled) client message.
+	wsMaxMessage = 64 * 1024
+
+	// wsWriteWait bounds every write to the peer.
+	wsWriteWait = 10 * time.Second
+)
+
+// wsGUID is appended to the client's key to compute the accept header.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsCloseError ends a connection with Code. Peer is set when
+// the client sent the close frame, otherwise Code is what the
+// server should send.
+type wsCloseError struct {
+	Code   int
+	Reason string
+	Peer   bool
+}
+
+func (e *wsCloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Reason)
+}
+
+// wsConn is an upgraded connection. Reads must happen on a single
+// goroutine; writes may come from any goroutine.
+type wsConn struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	writeMu sync.Mutex
+	closing bool // a close frame was sent, guarded by writeMu
+}
+
+// upgradeWebSocket performs the opening handshake. If the request
+// is not a valid WebSocket handshake it writes the error response
+// itself and returns false.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, bool) {
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		w.Header().Set("Upgrade", "websocket")
+		writeError(w, r, http.StatusUpgradeRequired, codeBadRequest, "this endpoint only speaks WebSocket")
+		return nil, false
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "unsupported WebSocket version")
+		return nil, false
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "malformed Sec-WebSocket-Key")
+		return nil, false
+	}
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "cannot take over the connection")
+		return nil, false
+	}
+	// The server's read and write timeouts still apply to the
+	// hijacked connection; from now on we manage them ourselves.
+	conn.SetDeadline(time.Time{})
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n"
+	conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, false
+	}
+	return &wsConn{conn: conn, br: brw.Reader}, true
+}
+
+// headerContains reports whether the comma separated header
+// name contains token, ignoring case.
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readMessage returns the next text message. Pings are answered
+// on the way; a close frame or a protocol violation ends the
+// connection with a *wsCloseError.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var message []byte
+	started := false
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			closeErr := &wsCloseError{Code: wsNoStatus, Peer: true}
+			if len(payload) >= 2 {
+				closeErr.Code = int(binary.BigEndian.Uint16(payload))
+				closeErr.Reason = string(payload[2:])
+			}
+			return nil, closeErr
+		case wsText:
+			if started {
+				return nil, &wsCloseError{Code: wsProtocolError, Reason: "expected a continuation frame"}
+			}
+			started = true
+		case wsContinuation:
+			if !started {
+				return nil, &wsCloseError{Code: wsProtocolError, Reason: "unexpected continuation frame"}
+			}
+		case wsBinary:
+			return nil, &wsCloseError{Code: wsUnsupportedData, Reason: "only text messages are supported"}
+		default:
+			return nil, &wsCloseError{Code: wsProtocolError, Reason: "unknown opcode"}
+		}
+
+		if len(message)+len(payload) > wsMaxMessage {
+			return nil, &wsCloseError{Code: wsMessageTooBig, Reason: "message too big"}
+		}
+		message = append(message, payload...)
+		if fin {
+			if !utf8.Valid(message) {
+				return nil, &wsCloseError{Code: wsInvalidPayload, Reason: "text is not UTF-8"}
+			}
+			return message, nil
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = head[0]&0x80 != 0
+	opcode = head[0] & 0x0f
+	if head[0]&0x70 != 0 {
+		return false, 0, nil, &wsCloseError{Code: wsProtocolError, Reason: "reserved bits set"}
+	}
+	if head[1]&0x80 == 0 {
+		return false, 0, nil, &wsCloseError{Code: wsProtocolError, Reason: "client frames must be masked"}
+	}
+
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= wsClose && (length > 125 || !fin) {
+		return false, 0, nil, &wsCloseError{Code: wsProtocolError, Reason: "malformed control frame"}
+	}
+	if length > wsMaxMessage {
+		return false, 0, nil, &wsCloseError{Code: wsMessageTooBig, Reason: "message too big"}
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// errWSClosing is returned for writes after the close frame.
+var errWSClosing = errors.New("websocket is closing")
+
+// writeFrame sends a single unmasked, unfragmented frame.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closing {
+		return errWSClosing
+	}
+	if opcode == wsClose {
+		c.closing = true
+	}
+
+	frame := make([]byte, 0, 10+len(payload))
+	frame = append(frame, 0x80|opcode)
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	frame = append(frame, payload...)
+
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+func (c *wsConn) writeText(message []byte) error {
+	return c.writeFrame(wsText, message)
+}
+
+// sendClose starts (or answers) the closing handshake.
+// wsNoStatus is sent as a close frame without a body.
+func (c *wsConn) sendClose(code int, reason string) error {
+	var payload []byte
+	if code != wsNoStatus {
+		payload = binary.BigEndian.AppendUint16(nil, uint16(code))
+		payload = append(payload, reason...)
+	}
+	return c.writeFrame(wsClose, payload)
+}
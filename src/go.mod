@@ -2,4 +2,4 @@ module crud_app
 
 go 1.21.5
 
-require github.com/gorilla/mux v1.8.1 // indirect
+require github.com/gorilla/mux v1.8.1
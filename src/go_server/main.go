@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+
+	"crud_app/server"
 )
 
 func formHandler(w http.ResponseWriter, r *http.Request) {
@@ -31,15 +35,21 @@ func helloHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	cfg := server.Defaults(":8080")
+	if err := cfg.RegisterFlags(flag.CommandLine, "GO_SERVER"); err != nil {
+		log.Fatal(err)
+	}
+	flag.Parse()
+
 	fileServer := http.FileServer(http.Dir("./static"))
 	http.Handle("/", fileServer)
 	http.HandleFunc("/form", formHandler)
 	http.HandleFunc("/hello", helloHandler)
 
-	fmt.Println("Starting server at port 8080")
+	fmt.Printf("Starting server at %s\n", cfg.Addr)
 
 	// Create a Web Server
-	if err := http.ListenAndServe(":8080", nil); err != nil {
+	if err := server.Run(context.Background(), cfg, nil); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,188 @@
+// Package permission is a bitmask permission encoding shared by our
+// services. It grew out of the constants tutorial, which packs
+// isAdmin, canSeeFinancials, canSeeAfrica, ... into the bits of a
+// single byte with `1 << iota`.
+//
+// A Permission is a set of flags. The tutorial's eight flags are
+// predefined; services can Define more of their own, which get the
+// next free bit. Flags have names, so a set can be written as
+// "admin|canSeeAsia" in configuration files, tokens and JSON.
+package permission
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// Permission is a set of permission flags, one per bit.
+type Permission uint64
+
+// The flags of the constants tutorial.
+const (
+	Admin              Permission = 1 << iota // 0000 0001
+	Headquarters                              // 0000 0010
+	CanSeeFinancials                          // 0000 0100
+	CanSeeAfrica                              // 0000 1000
+	CanSeeAsia                                // 0001 0000
+	CanSeeEurope                              // 0010 0000
+	CanSeeNorthAmerica                        // 0100 0000
+	CanSeeSouthAmerica                        // 1000 0000
+)
+
+// None is the empty set.
+const None Permission = 0
+
+// names holds the name of every defined flag, indexed by bit.
+var names = []string{
+	"admin",
+	"headquarters",
+	"canSeeFinancials",
+	"canSeeAfrica",
+	"canSeeAsia",
+	"canSeeEurope",
+	"canSeeNorthAmerica",
+	"canSeeSouthAmerica",
+}
+
+// Define adds a new flag called name and returns it. It is meant
+// to be called from package-level var declarations, before any
+// goroutines use the package:
+//
+//	var CanWriteMovies = permission.Define("canWriteMovies")
+//
+// Define panics if the name is taken or all 64 bits are in use.
+func Define(name string) Permission {
+	if name == "" || strings.ContainsAny(name, "| ,") {
+		panic(fmt.Sprintf("permission: invalid flag name %q", name))
+	}
+	for _, existing := range names {
+		if strings.EqualFold(existing, name) {
+			panic("permission: flag " + name + " is already defined")
+		}
+	}
+	if len(names) == 64 {
+		panic("permission: all 64 flags are in use")
+	}
+	names = append(names, name)
+	return 1 << (len(names) - 1)
+}
+
+// Set returns p with the flags of q added.
+func (p Permission) Set(q Permission) Permission { return p | q }
+
+// Clear returns p with the flags of q removed.
+func (p Permission) Clear(q Permission) Permission { return p &^ q }
+
+// Has reports whether p contains every flag of q.
+// It is the `isAdmin&roles == isAdmin` test of the tutorial.
+func (p Permission) Has(q Permission) bool { return p&q == q }
+
+// Any reports whether p contains at least one of the given flags.
+func (p Permission) Any(flags ...Permission) bool {
+	for _, q := range flags {
+		if p&q != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// All reports whether p contains every one of the given flags.
+func (p Permission) All(flags ...Permission) bool {
+	for _, q := range flags {
+		if !p.Has(q) {
+			return false
+		}
+	}
+	return true
+}
+
+// String lists the names of the flags in p separated by "|",
+// e.g. "admin|canSeeEurope". Bits without a defined flag are
+// written as hexadecimal numbers; the empty set is "none".
+func (p Permission) String() string {
+	if p == None {
+		return "none"
+	}
+	var parts []string
+	for rest := p; rest != 0; rest &= rest - 1 {
+		bit := bits.TrailingZeros64(uint64(rest))
+		if bit < len(names) {
+			parts = append(parts, names[bit])
+		} else {
+			parts = append(parts, "0x"+strconv.FormatUint(1<<bit, 16))
+		}
+	}
+	return strings.Join(parts, "|")
+}
+
+// Parse reads a set written by String. Flag names are matched
+// case-insensitively; numbers (decimal or 0x hex) stand for
+// raw bits. "|", "," and whitespace all separate flags.
+func Parse(s string) (Permission, error) {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == '|' || r == ',' || r == ' ' || r == '\t'
+	})
+
+	var p Permission
+	for _, field := range fields {
+		if strings.EqualFold(field, "none") {
+			continue
+		}
+		q, err := parseFlag(field)
+		if err != nil {
+			return None, err
+		}
+		p |= q
+	}
+	return p, nil
+}
+
+func parseFlag(field string) (Permission, error) {
+	for bit, name := range names {
+		if strings.EqualFold(name, field) {
+			return 1 << bit, nil
+		}
+	}
+	if n, err := strconv.ParseUint(field, 0, 64); err == nil {
+		return Permission(n), nil
+	}
+	return None, fmt.Errorf("permission: unknown flag %q", field)
+}
+
+// MarshalText and UnmarshalText use the String/Parse format,
+// which also makes Permission usable as a JSON map key.
+func (p Permission) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *Permission) UnmarshalText(text []byte) error {
+	parsed, err := Parse(string(text))
+	if err != nil {
+		return err
+	}
+	*p = parsed
+	return nil
+}
+
+// MarshalJSON writes p as a string such as "admin|canSeeAsia".
+func (p Permission) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+// UnmarshalJSON accepts the string form or a plain number.
+func (p *Permission) UnmarshalJSON(data []byte) error {
+	var n uint64
+	if err := json.Unmarshal(data, &n); err == nil {
+		*p = Permission(n)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("permission: want a string or number, got %s", data)
+	}
+	return p.UnmarshalText([]byte(s))
+}
@@ -0,0 +1,203 @@
+package permission
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// restoreNames undoes the Define calls of a test.
+func restoreNames(t *testing.T) {
+	saved := append([]string(nil), names...)
+	t.Cleanup(func() { names = saved })
+}
+
+func TestSetClear(t *testing.T) {
+	p := None.Set(Admin).Set(CanSeeAsia | CanSeeEurope)
+	if p != Admin|CanSeeAsia|CanSeeEurope {
+		t.Errorf("Set = %v", p)
+	}
+	if p = p.Clear(CanSeeAsia | Headquarters); p != Admin|CanSeeEurope {
+		t.Errorf("Clear = %v", p)
+	}
+	if p.Set(Admin) != p || p.Clear(CanSeeAfrica) != p {
+		t.Error("setting a present flag or clearing an absent one changed the set")
+	}
+}
+
+func TestHasAnyAll(t *testing.T) {
+	p := Admin | CanSeeAsia
+
+	tests := []struct {
+		name string
+		got  bool
+		want bool
+	}{
+		{"Has one", p.Has(Admin), true},
+		{"Has both", p.Has(Admin | CanSeeAsia), true},
+		{"Has missing", p.Has(Admin | CanSeeEurope), false},
+		{"Has none", p.Has(None), true},
+		{"Any hit", p.Any(CanSeeEurope, CanSeeAsia), true},
+		{"Any miss", p.Any(CanSeeEurope, Headquarters), false},
+		{"Any of nothing", p.Any(), false},
+		{"All hit", p.All(Admin, CanSeeAsia), true},
+		{"All miss", p.All(Admin, CanSeeEurope), false},
+		{"All of nothing", p.All(), true},
+		{"empty set Has", None.Has(Admin), false},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestStringParse(t *testing.T) {
+	tests := []struct {
+		p    Permission
+		want string
+	}{
+		{None, "none"},
+		{Admin, "admin"},
+		{Admin | CanSeeEurope, "admin|canSeeEurope"},
+		{CanSeeSouthAmerica | Headquarters, "headquarters|canSeeSouthAmerica"},
+		{1 << 40, "0x10000000000"},
+		{Admin | 1<<63, "admin|0x8000000000000000"},
+	}
+	for _, tt := range tests {
+		if got := tt.p.String(); got != tt.want {
+			t.Errorf("String(%#x) = %q, want %q", uint64(tt.p), got, tt.want)
+		}
+		parsed, err := Parse(tt.want)
+		if err != nil || parsed != tt.p {
+			t.Errorf("Parse(%q) = %#x, %v, want %#x", tt.want, uint64(parsed), err, uint64(tt.p))
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Permission
+	}{
+		{"", None},
+		{"none", None},
+		{"NONE|admin", Admin},
+		{"ADMIN, canseeasia", Admin | CanSeeAsia},
+		{" admin |\theadquarters ", Admin | Headquarters},
+		{"3", Admin | Headquarters},
+		{"0x30", CanSeeAsia | CanSeeEurope},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("Parse(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, in := range []string{"root", "admin|nope", "0xZZ", "-1"} {
+		if _, err := Parse(in); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", in)
+		}
+	}
+}
+
+func TestDefine(t *testing.T) {
+	restoreNames(t)
+
+	first := Define("canReadMovies")
+	second := Define("canWriteMovies")
+	if first != 1<<8 || second != 1<<9 {
+		t.Errorf("Define = %#x, %#x, want the next free bits", uint64(first), uint64(second))
+	}
+	if got := (first | Admin).String(); got != "admin|canReadMovies" {
+		t.Errorf("String = %q", got)
+	}
+	if p, err := Parse("canwritemovies"); err != nil || p != second {
+		t.Errorf("Parse = %v, %v, want %v", p, err, second)
+	}
+}
+
+func TestDefinePanics(t *testing.T) {
+	restoreNames(t)
+
+	for _, name := range []string{"", "a|b", "a b", "a,b", "admin", "ADMIN"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Define(%q) did not panic", name)
+				}
+			}()
+			Define(name)
+		}()
+	}
+
+	for len(names) < 64 {
+		Define(fmt.Sprintf("flag%d", len(names)))
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("Define did not panic with all 64 bits in use")
+		}
+	}()
+	Define("oneTooMany")
+}
+
+func TestJSON(t *testing.T) {
+	type config struct {
+		Roles Permission            `json:"roles"`
+		ByKey map[Permission]string `json:"by_key,omitempty"`
+	}
+
+	data, err := json.Marshal(config{Roles: Admin | CanSeeAsia, ByKey: map[Permission]string{CanSeeEurope: "eu"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"roles":"admin|canSeeAsia","by_key":{"canSeeEurope":"eu"}}`; string(data) != want {
+		t.Errorf("Marshal = %s, want %s", data, want)
+	}
+
+	tests := []struct {
+		in   string
+		want Permission
+	}{
+		{`{"roles": "admin|canSeeAsia"}`, Admin | CanSeeAsia},
+		{`{"roles": "none"}`, None},
+		{`{"roles": 17}`, Admin | CanSeeAsia},
+		{`{"roles": 0}`, None},
+		{`{"roles": "0x100"}`, 1 << 8},
+	}
+	for _, tt := range tests {
+		var c config
+		if err := json.Unmarshal([]byte(tt.in), &c); err != nil || c.Roles != tt.want {
+			t.Errorf("Unmarshal(%s) = %v, %v, want %v", tt.in, c.Roles, err, tt.want)
+		}
+	}
+
+	var c config
+	if err := json.Unmarshal([]byte(`{"by_key": {"admin|headquarters": "hq"}}`), &c); err != nil || c.ByKey[Admin|Headquarters] != "hq" {
+		t.Errorf("Unmarshal of map key = %v, %v", c.ByKey, err)
+	}
+	for _, in := range []string{`{"roles": "root"}`, `{"roles": true}`, `{"roles": -1}`} {
+		if err := json.Unmarshal([]byte(in), &c); err == nil {
+			t.Errorf("Unmarshal(%s) succeeded, want an error", in)
+		}
+	}
+}
+
+func TestText(t *testing.T) {
+	for _, p := range []Permission{None, Admin, Admin | CanSeeAsia | 1<<50} {
+		text, err := p.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Permission
+		if err := got.UnmarshalText(text); err != nil || got != p {
+			t.Errorf("text round trip of %s = %v, %v", text, got, err)
+		}
+	}
+	var p Permission
+	if err := p.UnmarshalText([]byte("admin|bogus")); err == nil {
+		t.Error("UnmarshalText of an unknown flag succeeded")
+	}
+}
@@ -0,0 +1,129 @@
+// Package server is the HTTP bootstrap shared by crud_app and go_server.
+// It reads the listen address, timeouts and header limit from flags
+// and environment variables, and shuts the server down gracefully
+// on SIGINT/SIGTERM.
+package server
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"crud_app/bytesize"
+)
+
+// Config holds the settings of an http.Server.
+type Config struct {
+	Addr            string
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	MaxHeaderBytes  bytesize.ByteSize
+	ShutdownTimeout time.Duration // how long in-flight requests may take to drain
+
+	// OnShutdown, if set, is called when the shutdown starts.
+	// Handlers that never finish on their own, like event
+	// streams, use it to end their responses so they do not
+	// hold up the shutdown until ShutdownTimeout.
+	OnShutdown func()
+}
+
+// Defaults returns a Config listening on addr with conservative timeouts.
+func Defaults(addr string) Config {
+	return Config{
+		Addr:            addr,
+		ReadTimeout:     15 * time.Second,
+		WriteTimeout:    15 * time.Second,
+		IdleTimeout:     60 * time.Second,
+		MaxHeaderBytes:  bytesize.MiB,
+		ShutdownTimeout: 10 * time.Second,
+	}
+}
+
+// RegisterFlags adds a flag for every setting to fs, using the
+// current values of c as defaults. Each flag can also be set
+// through an environment variable named after it, e.g. with
+// envPrefix "CRUD_APP" the -write-timeout flag reads
+// CRUD_APP_WRITE_TIMEOUT. Command line flags win over the
+// environment.
+func (c *Config) RegisterFlags(fs *flag.FlagSet, envPrefix string) error {
+	fs.StringVar(&c.Addr, "addr", c.Addr, "address to listen on")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", c.ReadTimeout, "maximum duration for reading a request")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", c.WriteTimeout, "maximum duration for writing a response")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", c.IdleTimeout, "how long keep-alive connections may stay idle")
+	fs.Var(&c.MaxHeaderBytes, "max-header-bytes", "maximum size of request headers, e.g. 64KiB")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "how long to wait for in-flight requests on shutdown")
+
+	for _, name := range []string{"addr", "read-timeout", "write-timeout", "idle-timeout", "max-header-bytes", "shutdown-timeout"} {
+		env := envPrefix + "_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		if value, ok := os.LookupEnv(env); ok {
+			if err := fs.Set(name, value); err != nil {
+				return fmt.Errorf("%s: %w", env, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Run serves handler with the given settings until ctx is cancelled
+// or the process receives SIGINT or SIGTERM. It then stops accepting
+// connections and waits up to cfg.ShutdownTimeout for in-flight
+// requests to finish. A nil handler means http.DefaultServeMux.
+func Run(ctx context.Context, cfg Config, handler http.Handler) error {
+	srv := &http.Server{
+		Addr:           cfg.Addr,
+		Handler:        handler,
+		ReadTimeout:    cfg.ReadTimeout,
+		WriteTimeout:   cfg.WriteTimeout,
+		IdleTimeout:    cfg.IdleTimeout,
+		MaxHeaderBytes: maxInt(cfg.MaxHeaderBytes),
+	}
+	if cfg.OnShutdown != nil {
+		srv.RegisterOnShutdown(cfg.OnShutdown)
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		// The server could not start (e.g. the port is taken).
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down, waiting up to %s for in-flight requests", cfg.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("shutdown: %w", err)
+	}
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	log.Println("Server stopped")
+	return nil
+}
+
+// maxInt converts a size to an int, saturating on overflow.
+func maxInt(b bytesize.ByteSize) int {
+	if uint64(b) > uint64(math.MaxInt) {
+		return math.MaxInt
+	}
+	return int(b)
+}